@@ -3,6 +3,10 @@ module repoharvester
 go 1.14
 
 require (
+	github.com/boltdb/bolt v1.3.1
 	github.com/jessevdk/go-flags v1.4.0
-	golang.org/x/sync v0.0.0-20200317015054-43a5402ce75a
+	golang.org/x/crypto v0.14.0
+	golang.org/x/net v0.17.0
+	golang.org/x/sync v0.4.0
+	golang.org/x/time v0.0.0-20190921001708-c4c64cad1fd0
 )
@@ -3,19 +3,43 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
 	"fmt"
+	"github.com/boltdb/bolt"
 	"github.com/jessevdk/go-flags"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/net/idna"
 	"golang.org/x/sync/semaphore"
+	"golang.org/x/time/rate"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
+	"path"
 	"path/filepath"
+	"reflect"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -25,13 +49,282 @@ import (
 )
 
 type Repo struct {
-	Name       string
-	Clone_url  string
-	Size       uint64
-	Fork       bool
-	local_path string // This will not be used by json to decode
+	Name             string
+	Clone_url        string
+	Size             uint64
+	Fork             bool
+	Owner            RepoOwner
+	Forks_url        string
+	Forks_count      uint32
+	Stargazers_count uint32
+	Private          bool // Internal repos are private too
+	Has_wiki         bool
+	Url              string // API url of the repo, used by --no-clone
+	Id               uint64 // Unlike the name these don't change on a rename
+	Node_id          string
+	Topics           []string // The current API lists them without the mercy-preview media type
+	Description      string
+	Homepage         string
+	Mirror_url       string // Null unless the repo mirrors a project hosted elsewhere
+	local_path       string // This will not be used by json to decode
+	wiki             bool   // Added by --include-wiki, the clone fails if no page was ever written
 }
 
+type RepoOwner struct {
+	Login string
+}
+
+// Azure DevOps returns every repo in a single object, and the size is in bytes
+type AzureRepo struct {
+	Name      string
+	RemoteUrl string
+	Size      uint64
+	IsFork    bool
+}
+
+type AzureRepoList struct {
+	Value   []AzureRepo
+	Count   int
+	Message string
+}
+
+// The object an API returns in place of the list when a request fails, e.g. {"message":"Not Found"}
+type ApiError struct {
+	Message           string
+	Documentation_url string
+}
+
+func (err *ApiError) Error() string {
+	return err.Message
+}
+
+// GitHub answers a missing user or org with a 404 and "Not Found", GitLab with e.g. "404 Group Not Found"
+func (err *ApiError) NotFound() bool {
+	return strings.HasSuffix(err.Message, "Not Found")
+}
+
+// The fields of a GitLab project that map onto a Repo
+type GitlabProject struct {
+	Id                  uint64
+	Path_with_namespace string
+	Http_url_to_repo    string
+	Star_count          uint32
+	Visibility          string
+	Topics              []string
+	Description         string
+	Forked_from_project *struct{}
+	Namespace           struct {
+		Full_path string
+	}
+}
+
+// A repo or page that failed in a stage, kept so users can retry or investigate
+type FailureRecord struct {
+	Stage  string
+	Repo   string `json:",omitempty"`
+	Url    string
+	Error  string
+	Reason string `json:",omitempty"`
+	Stderr string `json:",omitempty"`
+}
+
+type FailureLog struct {
+	mutex   sync.Mutex
+	records []FailureRecord
+}
+
+// Keep the stderr snippet short, the start of git's output has the reason
+const FAILURE_STDERR_LIMIT int = 1000
+
+func (failures *FailureLog) add(stage string, repo *Repo, url string, err error, std_err string) {
+	failures.add_reason(stage, repo, url, err, std_err, "")
+}
+
+func (failures *FailureLog) add_reason(stage string, repo *Repo, url string, err error, std_err string, reason string) {
+	if len(std_err) > FAILURE_STDERR_LIMIT {
+		std_err = std_err[:FAILURE_STDERR_LIMIT]
+	}
+	record := FailureRecord{Stage: stage, Url: url, Error: err.Error(), Reason: reason, Stderr: strings.TrimSpace(std_err)}
+	if repo != nil {
+		record.Repo = repo.Name
+		record.Url = repo.Clone_url
+	}
+	failures.mutex.Lock()
+	failures.records = append(failures.records, record)
+	failures.mutex.Unlock()
+}
+
+func (failures *FailureLog) Records() []FailureRecord {
+	failures.mutex.Lock()
+	defer failures.mutex.Unlock()
+	records := make([]FailureRecord, len(failures.records))
+	copy(records, failures.records)
+	return records
+}
+
+var g_failures FailureLog
+
+// Reason codes for a failed clone, taken from git's stderr
+const (
+	CLONE_NOT_FOUND     = "not_found"
+	CLONE_AUTH_REQUIRED = "auth_required"
+	CLONE_DISK_FULL     = "disk_full"
+	CLONE_NETWORK       = "network"
+	CLONE_UNKNOWN       = "unknown"
+)
+
+var CLONE_FAILURE_REASONS = []string{CLONE_NOT_FOUND, CLONE_AUTH_REQUIRED, CLONE_DISK_FULL, CLONE_NETWORK, CLONE_UNKNOWN}
+
+// Matched lower cased and in order, a 403 also says "unable to access" so auth is checked before network
+var CLONE_FAILURE_PATTERNS = []struct {
+	reason   string
+	patterns []string
+}{
+	{CLONE_DISK_FULL, []string{"no space left on device", "disk quota exceeded"}},
+	{CLONE_NOT_FOUND, []string{"repository not found", "does not exist", "does not appear to be a git repository", "error: 404"}},
+	{CLONE_AUTH_REQUIRED, []string{"authentication failed", "could not read username", "could not read password", "terminal prompts disabled", "permission denied", "invalid username or password", "error: 401", "error: 403"}},
+	{CLONE_NETWORK, []string{"could not resolve host", "failed to connect", "connection refused", "connection reset", "timed out", "early eof", "rpc failed", "remote end hung up", "unable to access", "ssl", "gnutls"}},
+}
+
+func classify_clone_error(std_err string) string {
+	lowered := strings.ToLower(std_err)
+	for _, class := range CLONE_FAILURE_PATTERNS {
+		for _, pattern := range class.patterns {
+			if strings.Contains(lowered, pattern) {
+				return class.reason
+			}
+		}
+	}
+	return CLONE_UNKNOWN
+}
+
+// Repos that are gone or need credentials are expected when a token can't see everything the API listed
+func clone_reason_is_expected(reason string) bool {
+	return reason == CLONE_NOT_FOUND || reason == CLONE_AUTH_REQUIRED
+}
+
+// One unit of work in a stage, a page for fetch and parse or a repo for the later stages
+type TraceSpan struct {
+	Stage   string
+	Name    string `json:",omitempty"`
+	Start   time.Time
+	End     time.Time
+	Seconds float64
+}
+
+// The spans of every stage, only recorded when --trace is set
+type Trace struct {
+	mutex   sync.Mutex
+	enabled bool
+	spans   []TraceSpan
+}
+
+// Meant to be deferred with time.Now() so the start is taken when the work begins
+func (trace *Trace) add(stage string, name string, start time.Time) {
+	if !trace.enabled {
+		return
+	}
+	end := time.Now()
+	trace.mutex.Lock()
+	trace.spans = append(trace.spans, TraceSpan{Stage: stage, Name: name, Start: start, End: end, Seconds: end.Sub(start).Seconds()})
+	trace.mutex.Unlock()
+}
+
+func (trace *Trace) Spans() []TraceSpan {
+	trace.mutex.Lock()
+	defer trace.mutex.Unlock()
+	spans := make([]TraceSpan, len(trace.spans))
+	copy(spans, trace.spans)
+	return spans
+}
+
+var g_trace Trace
+
+// One attempt at fetching a page of the repo listing, Retry is 0 for the first attempt
+type FetchRecord struct {
+	Url                string
+	Time               time.Time
+	Status             int `json:",omitempty"`
+	Seconds            float64
+	Retry              int
+	RateLimitRemaining string `json:",omitempty"`
+	Error              string `json:",omitempty"`
+}
+
+// Every page fetch attempt, only recorded when --fetch-log is set
+type FetchLog struct {
+	mutex   sync.Mutex
+	enabled bool
+	records []FetchRecord
+}
+
+// resp is nil when the request never got a response
+func (fetch_log *FetchLog) add(url string, start time.Time, retry int, resp *http.Response, err error) {
+	if !fetch_log.enabled {
+		return
+	}
+	record := FetchRecord{Url: url, Time: start, Seconds: time.Since(start).Seconds(), Retry: retry}
+	if resp != nil {
+		record.Status = resp.StatusCode
+		record.RateLimitRemaining = resp.Header.Get("X-RateLimit-Remaining")
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	fetch_log.mutex.Lock()
+	fetch_log.records = append(fetch_log.records, record)
+	fetch_log.mutex.Unlock()
+}
+
+func (fetch_log *FetchLog) Records() []FetchRecord {
+	fetch_log.mutex.Lock()
+	defer fetch_log.mutex.Unlock()
+	records := make([]FetchRecord, len(fetch_log.records))
+	copy(records, fetch_log.records)
+	return records
+}
+
+var g_fetch_log FetchLog
+
+// Targets the API redirected because they were renamed, old name to the canonical one
+type TargetRenames struct {
+	mutex sync.Mutex
+	names map[string]string
+}
+
+func (renames *TargetRenames) add(old_name string, new_name string) {
+	renames.mutex.Lock()
+	renames.names[old_name] = new_name
+	renames.mutex.Unlock()
+}
+
+// Whether login is the new name of a renamed target, compared case insensitively like the owner filter
+func (renames *TargetRenames) RenamedTo(login string) bool {
+	renames.mutex.Lock()
+	defer renames.mutex.Unlock()
+	for _, new_name := range renames.names {
+		if strings.EqualFold(new_name, login) {
+			return true
+		}
+	}
+	return false
+}
+
+func (renames *TargetRenames) Names() map[string]string {
+	renames.mutex.Lock()
+	defer renames.mutex.Unlock()
+	names := make(map[string]string, len(renames.names))
+	for old_name, new_name := range renames.names {
+		names[old_name] = new_name
+	}
+	return names
+}
+
+var g_renames = TargetRenames{names: make(map[string]string)}
+
+// Set when the API said the target doesn't exist, to tell that apart from a target without repos
+var g_target_not_found uint32
+
 type EmailContext struct {
 	Repo         *Repo
 	EmailAddress string
@@ -41,10 +334,16 @@ type EmailContext struct {
 const (
 	ROLE_AUTHOR         int8   = 1 << iota
 	ROLE_COMMITTER      int8   = 1 << iota
+	ROLE_TAGGER         int8   = 1 << iota
+	ROLE_PR_AUTHOR      int8   = 1 << iota
 	ROLE_NAME_COMMITTER string = "Committer"
 	ROLE_NAME_AUTHOR    string = "Author"
 	ROLE_NAME_BOTH      string = "Author+Committer"
-	ROLE_MASK_BOTH      int8   = ROLE_AUTHOR | ROLE_COMMITTER
+	ROLE_NAME_TAGGER    string = "Tagger"
+	ROLE_NAME_PR_AUTHOR string = "PR Author"
+	// Used for every role with --roles combined
+	ROLE_NAME_CONTRIBUTOR string = "Contributor"
+	ROLE_MASK_BOTH        int8   = ROLE_AUTHOR | ROLE_COMMITTER
 )
 
 type EmailGroupByRepoKey struct {
@@ -54,15 +353,117 @@ type EmailGroupByRepoKey struct {
 
 type FmtEmailPerRepo struct {
 	RepoUrl string
-	Emails  map[string]string
+	RepoId  uint64 `json:",omitempty"`
+	NodeId  string `json:",omitempty"`
+	// Often name internal projects and hosts
+	Description string `json:",omitempty"`
+	Homepage    string `json:",omitempty"`
+	Emails      map[string]string
+	// Directory to email to authored commits, from --by-directory
+	Directories map[string]map[string]uint64 `json:",omitempty"`
 }
 
-type FmtRepoPerEmail struct {
+type FmtWidespreadEmail struct {
+	Email     string
+	RepoCount int
+}
+
+type WebhookSummary struct {
+	Target          string
+	TargetType      string
+	Repos           uint32
+	Emails          int
+	Identities      uint32
+	DurationSeconds float64
+	ErrorCount      uint32
+	ExitCode        int
+}
+
+type FmtBaselineRepo struct {
 	RepoName string
-	Role     string
 	RepoUrl  string
 }
 
+type FmtBaselineDiff struct {
+	NewEmails     []string          `json:"new_emails"`
+	RemovedEmails []string          `json:"removed_emails"`
+	NewRepos      []FmtBaselineRepo `json:"new_repos"`
+	RemovedRepos  []FmtBaselineRepo `json:"removed_repos"`
+}
+
+// The --file list and the --json document in one file for --combined
+type FmtCombined struct {
+	Emails  []string               `json:"emails"`
+	Grouped map[string]interface{} `json:"grouped"`
+}
+
+// The emails and repos (keyed by clone url) of a previous run's JSON output
+type Baseline struct {
+	Emails map[string]bool
+	Repos  map[string]string
+}
+
+type FmtTopContributor struct {
+	Email   string
+	Domain  string
+	Commits uint64
+}
+
+type FmtNewDomain struct {
+	Domain     string
+	EmailCount int
+}
+
+type FmtDomainInfo struct {
+	Resolves  bool
+	MailHosts []string
+}
+
+type FmtRepoPerEmail struct {
+	RepoName  string
+	RepoOwner string `json:",omitempty"`
+	Role      string
+	RepoUrl   string
+	Lines     uint64 `json:",omitempty"`
+	Private   bool   `json:",omitempty"`
+}
+
+// How the results were produced, written to the JSON under meta
+type FmtMeta struct {
+	Version    string
+	Target     string
+	TargetType string
+	Started    time.Time
+	// Every harvest flag by its long name as resolved after the defaults and environment
+	Options map[string]interface{}
+}
+
+// Flags whose values are secrets, only whether they were set is recorded
+var REDACTED_OPTIONS = []string{"token", "passphrase", "webhook-url"}
+
+func options_meta(groups ...interface{}) map[string]interface{} {
+	options := make(map[string]interface{})
+	for _, group := range groups {
+		group_value := reflect.ValueOf(group)
+		for i := 0; i < group_value.NumField(); i++ {
+			name := group_value.Type().Field(i).Tag.Get("long")
+			if len(name) == 0 {
+				continue
+			}
+			value := group_value.Field(i).Interface()
+			if contains_string(REDACTED_OPTIONS, name) {
+				if !group_value.Field(i).IsZero() {
+					value = "[REDACTED]"
+				}
+			} else if duration, ok := value.(time.Duration); ok {
+				value = duration.String()
+			}
+			options[name] = value
+		}
+	}
+	return options
+}
+
 var active_data []uint32
 var error_data []uint32
 var completion_data []uint32
@@ -83,11 +484,75 @@ const (
 
 const DEFAULT_SIZE_FILTER int = 1000000
 
+// Set from the release tag by the Makefile with -ldflags "-X main.VERSION=<tag>"
+var VERSION string = "dev"
+
+const GITHUB_API_URL string = "https://api.github.com"
+
+// Default for --path-template, the repo listing of a user or org
+const GITHUB_REPOS_PATH_TEMPLATE string = "/{target-type}/{target-name}/repos"
+
+// GitHub caps per_page at 100
+const GITHUB_MAX_PER_PAGE int = 100
+
+// Fills in the --path-template for a target and adds the page size
+func github_repos_url(path_template string, target_type string, target_name string) string {
+	r := strings.NewReplacer("{target-type}", target_type, "{target-name}", target_name)
+	repos_url := GITHUB_API_URL + r.Replace(path_template)
+	if strings.Contains(repos_url, "?") {
+		return repos_url + "&per_page=" + strconv.Itoa(PER_PAGE)
+	}
+	return repos_url + "?per_page=" + strconv.Itoa(PER_PAGE)
+}
+
+// Values the GitHub API accepts for the repo listing query params
+var (
+	REPO_TYPES_ORG   = []string{"all", "public", "private", "forks", "sources", "member"}
+	REPO_TYPES_USER  = []string{"all", "owner", "member"}
+	REPO_AFFILIATION = []string{"owner", "collaborator", "organization_member"}
+)
+
+// Exit codes, partial output is always written before exiting with a stage error code
+const (
+	EXIT_OK           int = 0
+	EXIT_FATAL        int = 1 // Bad arguments or a logger.Fatal
+	EXIT_STAGE_ERRORS int = 2 // Completed, but at least one stage had errors
+	EXIT_STRICT_ABORT int = 3 // Stopped early by --strict on the first error
+)
+
+// Each repo can emit many identities, so the shortlog output queues are sized larger by default
+const IDENTITY_QUEUE_MULTIPLIER int = 50
+
+// Metric label names, indexed the same as the counters above
+var (
+	STAGE_NAMES = []string{"github_fetch", "github_parse", "git_clone", "git_shortlog", "emails_dedup", "emails_grouped"}
+	QUEUE_NAMES = []string{"github_pages", "remote_repos", "local_repos", "git_identities"}
+)
+
 var (
 	LINE_SEP    string
 	g_buff_pool sync.Pool
 	g_semaphore *semaphore.Weighted
-	BUFFER_SIZE int
+	// Caps the work goroutines alive across the stages, including the ones blocked on a full queue
+	g_live_work   *semaphore.Weighted
+	g_http_client *http.Client
+	g_api_limiter *rate.Limiter
+	BUFFER_SIZE   int
+	// Per boundary channel capacities, these fall back to BUFFER_SIZE
+	PAGE_BUFFER_SIZE     int
+	REPO_BUFFER_SIZE     int
+	IDENTITY_BUFFER_SIZE int
+	API_TOKEN            string
+	// Retries after the first attempt at a page and the wait before each, which grows with the attempt
+	FETCH_RETRIES int
+	FETCH_BACKOFF time.Duration
+	// Page size requested from the GitHub API
+	PER_PAGE int
+	// Entries the aggregation holds in memory before moving to a file in SPILL_DIR, 0 never spills
+	SPILL_THRESHOLD int
+	SPILL_DIR       string
+	// Shortlog jobs each cloned repo adds to the stage 4 total, 1 with --authors-only and one more with --include-tags
+	SHORTLOG_PASSES uint32 = 2
 )
 
 // Logging code
@@ -98,6 +563,9 @@ const (
 	LOG_DEBUG uint8 = 3
 )
 
+// Prefix each line with an RFC3339 timestamp, off for systems that add their own
+var LOG_TIMESTAMPS bool = true
+
 type Logger struct {
 	Panic     func(...interface{})
 	Fatal     func(...interface{})
@@ -164,86 +632,95 @@ func (logger *Logger) LogLevel() uint8 {
 
 // Do the main logging functions in a goroutine to ensure they don't slow down the main operation
 func (logger *Logger) log_debug(a ...interface{}) {
+	when := time.Now()
 	logger.wg.Add(1)
 	go func() {
 		msg := fmt.Sprint(a...)
-		log("DEBUG", &msg)
+		log("DEBUG", &msg, when)
 		logger.wg.Done()
 	}()
 }
 
 func (logger *Logger) logf_debug(format string, a ...interface{}) {
+	when := time.Now()
 	logger.wg.Add(1)
 	go func() {
 		msg := fmt.Sprintf(format, a...)
-		log("DEBUG", &msg)
+		log("DEBUG", &msg, when)
 		logger.wg.Done()
 	}()
 }
 
 func (logger *Logger) logfunc_debug(logfunc func() (string, bool)) {
+	when := time.Now()
 	logger.wg.Add(1)
 	go func() {
 		msg, ok := logfunc()
 		if ok {
-			log("DEBUG", &msg)
+			log("DEBUG", &msg, when)
 		}
 		logger.wg.Done()
 	}()
 }
 
 func (logger *Logger) log_info(a ...interface{}) {
+	when := time.Now()
 	logger.wg.Add(1)
 	go func() {
 		msg := fmt.Sprint(a...)
-		log("INFO", &msg)
+		log("INFO", &msg, when)
 		logger.wg.Done()
 	}()
 }
 
 func (logger *Logger) logf_info(format string, a ...interface{}) {
+	when := time.Now()
 	logger.wg.Add(1)
 	go func() {
 		msg := fmt.Sprintf(format, a...)
-		log("INFO", &msg)
+		log("INFO", &msg, when)
 		logger.wg.Done()
 	}()
 }
 
 func (logger *Logger) logfunc_info(logfunc func() (string, bool)) {
+	when := time.Now()
 	logger.wg.Add(1)
 	go func() {
 		msg, ok := logfunc()
 		if ok {
-			log("INFO", &msg)
+			log("INFO", &msg, when)
 		}
 		logger.wg.Done()
 	}()
 }
 
 func (logger *Logger) log_error(a ...interface{}) {
+	when := time.Now()
 	logger.wg.Add(1)
 	go func() {
 		msg := fmt.Sprint(a...)
-		log("ERROR", &msg)
+		log("ERROR", &msg, when)
 		logger.wg.Done()
 	}()
 }
 func (logger *Logger) logf_error(format string, a ...interface{}) {
+	when := time.Now()
 	logger.wg.Add(1)
 	go func() {
 		msg := fmt.Sprintf(format, a...)
-		log("ERROR", &msg)
+		log("ERROR", &msg, when)
 		logger.wg.Done()
 	}()
 }
 
 func (logger *Logger) logfunc_error(logfunc func() (string, bool)) {
+	when := time.Now()
 	logger.wg.Add(1)
 	go func() {
 		msg, ok := logfunc()
 		if ok {
-			log("ERROR", &msg)
+			log("ERROR", &msg, when)
 		}
 		logger.wg.Done()
 	}()
@@ -252,18 +729,22 @@ func (logger *Logger) logfunc_error(logfunc func() (string, bool)) {
 // These two functions terminate execution so they don't run async
 func (logger *Logger) log_fatal(a ...interface{}) {
 	msg := fmt.Sprint(a...)
-	log("FATAL", &msg)
+	log("FATAL", &msg, time.Now())
 	os.Exit(1)
 }
 func (logger *Logger) log_panic(a ...interface{}) {
 	msg := fmt.Sprint(a...)
-	log("PANIC", &msg)
+	log("PANIC", &msg, time.Now())
 	panic(msg)
 }
 
-func log(level string, msg *string) {
+func log(level string, msg *string, when time.Time) {
 	out := g_buff_pool.Get().(*bytes.Buffer)
 	out.Reset()
+	if LOG_TIMESTAMPS {
+		out.WriteString(when.Format(time.RFC3339))
+		out.WriteString(" ")
+	}
 	out.WriteString(level)
 	out.WriteString(": ")
 	out.WriteString(*msg)
@@ -296,34 +777,119 @@ var logger Logger
 // End logging functions
 
 type ResourceOptions struct {
-	Type       string `short:"t" long:"type" description:"type of object to target" choice:"user" choice:"org" choice:"url"`
-	Org        bool   `short:"o" long:"org" description:"alias to --type org" group:"parse-type"`
-	User       bool   `short:"u" long:"user" description:"alias to --type user" group:"parse-type"`
-	Url        bool   `long:"url" description:"alias to --type url" group:"parse-type"`
-	SizeFilter uint64 `long:"size-filter" value-name:"<size in kB>" description:"repo size to filter (set 0 to disable)" default:"1000000" long-description:"There are often repos that are asset heavy and increase the faceprint time without a lot of gain. This filters those out."`
-	ForkFilter bool   `long:"no-fork" description:"filter out forked repos"`
+	Type        string   `short:"t" long:"type" description:"type of object to target" choice:"user" choice:"org" choice:"url" choice:"azure-devops" choice:"enterprise" choice:"gitlab"`
+	Org         bool     `short:"o" long:"org" description:"alias to --type org" group:"parse-type"`
+	User        bool     `short:"u" long:"user" description:"alias to --type user" group:"parse-type"`
+	Url         bool     `long:"url" description:"alias to --type url" group:"parse-type"`
+	SizeFilter  uint64   `long:"size-filter" value-name:"<size in kB>" description:"repo size to filter (set 0 to disable)" default:"1000000" long-description:"There are often repos that are asset heavy and increase the faceprint time without a lot of gain. This filters those out."`
+	ForkFilter  bool     `long:"no-fork" description:"filter out forked repos"`
+	NoMirrors   bool     `long:"no-mirrors" description:"filter out the repos that mirror a project hosted elsewhere (GitHub only)"`
+	OwnerOnly   bool     `long:"owner-only" description:"filter out repos not owned by the target (user or org only)"`
+	MinStars    uint32   `long:"min-stars" value-name:"<int>" description:"filter out repos with fewer stars than this"`
+	Topics      []string `long:"topic" value-name:"<topic>" description:"only harvest the repos with this topic (can be repeated, any of them matches)"`
+	SkipTopics  []string `long:"exclude-topic" value-name:"<topic>" description:"filter out the repos with this topic (can be repeated)"`
+	RepoType    string   `long:"repo-type" value-name:"<type>" description:"repo type for the API to list (org: all|public|private|forks|sources|member, user: all|owner|member)"`
+	Affiliation string   `long:"affiliation" value-name:"<list>" description:"comma separated affiliations for the API to list (user only: owner,collaborator,organization_member)"`
+	WithForks   bool     `long:"include-fork-contributors" description:"also harvest the forks of each repo (GitHub only)"`
+	WithWikis   bool     `long:"include-wiki" description:"also harvest the wiki of each repo that has one enabled, as <repo>.wiki (GitHub only)"`
+	MemberRepos bool     `long:"include-member-repos" description:"also harvest the personal repos of the org's members (public members only without a member's token)"`
+	Search      bool     `long:"search" description:"treat the target-name as a search (acme-* style wildcards allowed) and harvest every matching user or org"`
+	Token       string   `long:"token" env:"REPOHARVESTER_TOKEN" value-name:"<token>" description:"API token (for azure-devops this is a PAT sent over basic auth)"`
+	AppId       uint64   `long:"app-id" value-name:"<id>" description:"authenticate as this GitHub App instead of a --token"`
+	AppInstall  uint64   `long:"app-installation-id" value-name:"<id>" description:"installation of the GitHub App to mint tokens for"`
+	AppKey      string   `long:"app-key" value-name:"<key.pem>" description:"private key of the GitHub App"`
+	GitlabUrl   string   `long:"gitlab-url" value-name:"<url>" description:"GitLab instance to harvest a group from" default:"https://gitlab.com"`
+	Subgroups   bool     `long:"include-subgroups" description:"also harvest the projects of every subgroup (gitlab only)"`
 }
 
 type OutputOptions struct {
-	OutputJson flags.Filename `short:"j" long:"json" description:"Output JSON file" value-name:"output.json" required:"true"`
-	OutputFile flags.Filename `short:"f" long:"file" description:"Output flat file" value-name:"output.list" required:"true"`
+	OutputJson      flags.Filename `short:"j" long:"json" description:"Output JSON file" value-name:"output.json"`
+	OutputFile      flags.Filename `short:"f" long:"file" description:"Output flat file" value-name:"output.list"`
+	EmailsOnly      flags.Filename `long:"emails-only" description:"Output flat file like --file with bot accounts left out, for handing off" value-name:"emails.list"`
+	Names           flags.Filename `long:"names" description:"Output flat file of the unique contributor names, sorted, with bot accounts left out" value-name:"names.list"`
+	Combined        flags.Filename `long:"combined" description:"Output JSON file with the --file list under emails and the --json document under grouped, can replace both" value-name:"combined.json"`
+	Report          flags.Filename `long:"report" description:"Output text file summarizing the domains, top contributors and the repos with the most identities" value-name:"report.txt"`
+	CountOnly       bool           `long:"count-only" description:"print the number of unique emails, domains and repos instead of writing the --file and --json outputs"`
+	WithVisibility  bool           `long:"with-visibility" description:"mark the private repos in the JSON and add whether each email is in any private repo (needs a --token to see private repos)"`
+	NestByOwner     bool           `long:"nest-by-owner" description:"nest the repos in the JSON output under their owner"`
+	Roles           string         `long:"roles" description:"detailed keeps Author, Committer and Author+Committer apart, combined lists everyone as a Contributor" choice:"detailed" choice:"combined" default:"detailed"`
+	DomainAllowlist string         `long:"domain-allowlist" value-name:"<list>" description:"comma separated email domains to keep (subdomains included), everything else is dropped"`
+	TargetDomains   string         `long:"target-domains" value-name:"<list>" description:"comma separated email domains of the target (subdomains included), the JSON marks the emails in them as internal (defaults to the most common domain)"`
+	ValidateDomains bool           `long:"validate-domains" description:"look up the MX records of each domain and add them to the JSON"`
+	KnownDomains    flags.Filename `long:"known-domains" description:"file of already known domains, one per line. The JSON gets a new_domains list of the others" value-name:"known.list"`
+	Widespread      flags.Filename `long:"widespread" description:"Output file of the emails found in more than --widespread-threshold repos" value-name:"widespread.list"`
+	Top             int            `long:"top" description:"print the emails with the most authored commits at the end" value-name:"<int>"`
+	WidespreadMin   int            `long:"widespread-threshold" description:"repo count an email has to exceed to be widespread" default:"1" value-name:"<int>"`
+	Graph           flags.Filename `long:"graph" description:"Output graph of emails to repos" value-name:"graph.dot"`
+	GraphFormat     string         `long:"graph-format" description:"format of the --graph output" choice:"dot" choice:"gexf" default:"dot"`
+	Baseline        flags.Filename `long:"baseline" description:"JSON output of a previous run to compare against (needs --diff)" value-name:"previous.json"`
+	DiffFile        flags.Filename `long:"diff" description:"Output JSON file of the emails and repos added or removed since the --baseline" value-name:"diff.json"`
+	Activity        flags.Filename `long:"activity" description:"Output JSON file of commit counts per domain by hour of day (walks the full history)" value-name:"activity.json"`
+	NoIdentityRepos flags.Filename `long:"no-identity-repos" description:"Output file of the repos that cloned fine but had no emails (after the --domain-allowlist)" value-name:"empty.list"`
+	ErrorsFile      flags.Filename `long:"errors-file" description:"Output JSON file of the repos and pages that failed, with the error from git" value-name:"errors.json"`
+	Trace           flags.Filename `long:"trace" description:"Output JSON file of the start and end of every stage and repo operation, with the slowest repos" value-name:"trace.json"`
+	FetchLog        flags.Filename `long:"fetch-log" description:"Output JSON file of every page fetch of the repo listing with its HTTP status, duration and retry" value-name:"fetch.json"`
+	RawShortlogDir  flags.Filename `long:"raw-shortlog-dir" description:"write each repo's raw shortlog output to this directory" value-name:"<dir>"`
+	PerRepoDir      flags.Filename `long:"per-repo-dir" description:"write a CSV of the emails, names, roles and authored commits of each repo to this directory" value-name:"<dir>"`
+	Gzip            bool           `long:"gzip" description:"gzip the output files (written with a .gz extension, before the .enc of --encrypt)"`
+	Encrypt         bool           `long:"encrypt" description:"encrypt the output files with a passphrase (written with a .enc extension)"`
+	Passphrase      string         `long:"passphrase" env:"REPOHARVESTER_PASSPHRASE" value-name:"<passphrase>" description:"passphrase for --encrypt and an encrypted --baseline"`
 }
 
 type Positional struct {
-	TargetName string `positional-arg-name:"target-name" description:"The name of the user or org to faceprint"`
+	TargetName string `positional-arg-name:"target-name" description:"The name of the user or org to faceprint (<org>/<project> for azure-devops, the slug for enterprise, the group path for gitlab)"`
 }
 
 type ApplicationOptions struct {
-	Verbose     bool           `short:"v" long:"verbose" description:"Show verbose debug information"`
-	Quiet       bool           `short:"q" long:"quiet" description:"Show fewer messages"`
-	PreserveDir bool           `long:"preserve-dir" description:"preserve working directory"`
-	WorkingDir  flags.Filename `short:"w" long:"working-dir" value-name:"<path_to_working_dir>" default:"!None-Provided!" default-mask:"Uses working directory" description:"working dir path (should have space to store all repos)"`
-	GitPath     flags.Filename `long:"git-path" short:"g" description:"path to git" value-name:"<path_to_git>" default:"!None-Provided!" default-mask:"Uses system git"`
+	Verbose         bool           `short:"v" long:"verbose" description:"Show verbose debug information"`
+	Quiet           bool           `short:"q" long:"quiet" description:"Show fewer messages"`
+	StatusInterval  time.Duration  `long:"status-interval" description:"print the status table this often while running (0 to disable)" default:"10s" value-name:"<duration>"`
+	LogTimestamps   string         `long:"log-timestamps" description:"prefix log lines with an RFC3339 timestamp" choice:"true" choice:"false" default:"true"`
+	VerboseHttp     bool           `long:"verbose-http" description:"log the method, url, status and headers of every HTTP request with the credentials redacted (implies --verbose)"`
+	PreserveDir     bool           `long:"preserve-dir" description:"preserve working directory"`
+	CleanupClones   bool           `long:"cleanup-clones" description:"remove each repo's clone as soon as its emails are read to keep the disk usage down"`
+	PreserveOnError bool           `long:"preserve-on-error" description:"keep the clones of repos that failed, and the working dir, for inspection"`
+	Strict          bool           `long:"strict" description:"stop on the first error in any stage (partial output is still written)"`
+	RamDiskSize     uint64         `long:"ram-disk-size" value-name:"<size in kB>" description:"refuse to clone if the repos won't fit in this much space (for a tmpfs working dir)"`
+	MaxDisk         uint64         `long:"max-disk" value-name:"<size in kB>" description:"stop cloning once the repos cloned add up to this much (by the size the API reports)"`
+	ReuseClones     bool           `long:"reuse-clones" description:"update the clones already in the working dir with git fetch instead of cloning again (pairs with --preserve-dir)"`
+	DeepenThreshold int            `long:"deepen-threshold" value-name:"<int>" description:"fetch the full history of shallow clones with fewer author emails than this (clones with --depth=100 unless --git-clone-args sets a depth)"`
+	NoClone         bool           `long:"no-clone" description:"read the emails from the commits API instead of cloning (GitHub only, no git needed)"`
+	GraphQL         bool           `long:"graphql" description:"with --no-clone, read the commit history of several repos per request from the GraphQL API (needs a --token)"`
+	IncludeTags     bool           `long:"include-tags" description:"also collect the taggers of annotated tags, with a Tagger role"`
+	AuthorsOnly     bool           `long:"authors-only" description:"only collect commit authors, skipping the committer shortlog and the Committer and Author+Committer roles"`
+	ExcludeVendor   bool           `long:"exclude-vendor" description:"leave out the commits that only touch vendor, node_modules or third_party directories"`
+	ExcludePaths    []string       `long:"exclude-path" value-name:"<dir>" description:"leave out the commits that only touch this directory, at any depth (can be repeated)"`
+	WithBlame       bool           `long:"with-blame" description:"count the lines each email owns with git blame and add them to the JSON (slow)"`
+	BlameMaxFiles   int            `long:"blame-max-files" description:"maximum files to blame per repo" default:"200" value-name:"<int>"`
+	PrAuthors       bool           `long:"pr-authors" description:"also collect the authors of each repo's pull requests from the API, with a PR Author role (GitHub only)"`
+	ByDirectory     int            `long:"by-directory" value-name:"<depth>" description:"also count the authored commits of each email per directory at this depth (1 is the top level) and add them to each repo in the JSON"`
+	WorkingDir      flags.Filename `short:"w" long:"working-dir" value-name:"<path_to_working_dir>" default:"!None-Provided!" default-mask:"Uses working directory" description:"working dir path (should have space to store all repos)"`
+	GitPath         flags.Filename `long:"git-path" short:"g" description:"path to git" value-name:"<path_to_git>" default:"!None-Provided!" default-mask:"Uses system git"`
+	GitCreds        bool           `long:"use-git-credentials" description:"clone using your git credential helpers/.netrc instead of the --token"`
+	GitCloneArgs    string         `long:"git-clone-args" description:"extra flags for git clone, space separated (a --filter replaces the default --filter=tree:0)" value-name:"<args>"`
 }
 
 type AdvancedOptions struct {
-	Workers   int8 `long:"workers" description:"numbers of workers to use" default:"20" value-name:"<int>"`
-	QueueSize int  `long:"queue-size" description:"base size of the operating queue" default:"20" value-name:"<int>"`
+	Workers           int8          `long:"workers" description:"numbers of workers to use" default:"20" value-name:"<int>"`
+	MaxLiveWork       int           `long:"max-live-work" description:"work goroutines alive at once across the stages, including those waiting on a full queue (0 matches --workers)" default:"0" value-name:"<int>"`
+	QueueSize         int           `long:"queue-size" description:"base size of the operating queue" default:"20" value-name:"<int>"`
+	PageQueueSize     int           `long:"page-queue-size" description:"size of the fetched page queue (0 uses --queue-size)" default:"0" value-name:"<int>"`
+	RepoQueueSize     int           `long:"repo-queue-size" description:"size of the repo queues between parse, clone and shortlog (0 uses --queue-size)" default:"0" value-name:"<int>"`
+	IdentityQueueSize int           `long:"identity-queue-size" description:"size of the identity queues feeding the aggregation (0 uses 50x --queue-size)" default:"0" value-name:"<int>"`
+	ApiRate           float64       `long:"api-rate" description:"maximum API requests per second (set 0 to disable)" default:"1" value-name:"<reqs/sec>"`
+	FetchRetries      int           `long:"fetch-retries" description:"times to retry a page that failed to fetch" default:"3" value-name:"<int>"`
+	FetchBackoff      time.Duration `long:"fetch-backoff" description:"wait before a retry, multiplied by the attempt number" default:"500ms" value-name:"<duration>"`
+	PathTemplate      string        `long:"path-template" description:"GitHub API path to list the repos from, {target-type} and {target-name} are filled in (e.g. /orgs/{target-name}/teams/<team>/repos)" default:"/{target-type}/{target-name}/repos" value-name:"<path>"`
+	PerPage           int           `long:"per-page" description:"results per API page (GitHub allows up to 100)" default:"100" value-name:"<int>"`
+	SincePaging       bool          `long:"since-paging" description:"page through the repo listing with since=<last repo id> instead of page numbers, for listings that support it like /repositories (GitHub only)"`
+	AggregateWorkers  int           `long:"aggregate-workers" description:"goroutines for each aggregation stage, their partial results are merged at the end (can't be used with --spill-threshold)" default:"1" value-name:"<int>"`
+	SpillThreshold    int           `long:"spill-threshold" description:"move the email aggregation to a file in the working dir once it holds this many entries (0 keeps it in memory)" default:"0" value-name:"<int>"`
+	MetricsAddr       string        `long:"metrics-addr" description:"serve Prometheus metrics on this address (e.g. :9090)" value-name:"<host:port>"`
+	WebhookUrl        string        `long:"webhook-url" description:"POST a JSON summary of the run to this URL once the output is written" value-name:"<url>"`
+	UserAgent         string        `long:"user-agent" description:"User-Agent header sent with the API requests (defaults to repoharvester/<version>)" value-name:"<string>"`
+	StallWarning      time.Duration `long:"stall-warning" description:"log the git operations that have held a worker for longer than this (0 to disable)" default:"10m" value-name:"<duration>"`
+	StallKill         time.Duration `long:"stall-kill" description:"kill the git operations that have held a worker for longer than this (0 never kills)" default:"0" value-name:"<duration>"`
 }
 
 var opts struct {
@@ -335,7 +901,68 @@ var opts struct {
 	Advanced    AdvancedOptions    `group:"Advanced Options"`
 }
 
-var parser = flags.NewParser(&opts, flags.Default)
+type DecryptCommand struct {
+	Passphrase string `long:"passphrase" env:"REPOHARVESTER_PASSPHRASE" value-name:"<passphrase>" description:"passphrase the file was encrypted with" required:"yes"`
+	Args       struct {
+		File flags.Filename `positional-arg-name:"file.enc" description:"The --encrypt output to decrypt"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+type DiffCommand struct {
+	DiffFile   flags.Filename `short:"o" long:"output" description:"Output JSON file of the emails and repos added or removed" value-name:"diff.json" required:"yes"`
+	Encrypt    bool           `long:"encrypt" description:"encrypt the output file with a passphrase (written with a .enc extension)"`
+	Passphrase string         `long:"passphrase" env:"REPOHARVESTER_PASSPHRASE" value-name:"<passphrase>" description:"passphrase for --encrypt and encrypted inputs"`
+	Args       struct {
+		Previous flags.Filename `positional-arg-name:"previous.json" description:"JSON output of the earlier run"`
+		Current  flags.Filename `positional-arg-name:"current.json" description:"JSON output of the later run"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+var decrypt_opts DecryptCommand
+var diff_opts DiffCommand
+
+// Options that come before the command
+var global_opts struct {
+	ListSources bool `long:"list-sources" description:"print the supported target types and the flags they need, tab separated, and exit"`
+}
+
+// A target type this build can harvest, printed by --list-sources
+type TargetSource struct {
+	Type       string
+	Platform   string
+	TargetName string
+	Requires   string
+}
+
+var TARGET_SOURCES = []TargetSource{
+	{Type: "user", Platform: "github", TargetName: "<login>", Requires: "-"},
+	{Type: "org", Platform: "github", TargetName: "<org>", Requires: "-"},
+	{Type: "enterprise", Platform: "github", TargetName: "<enterprise-slug>", Requires: "--token"},
+	{Type: "url", Platform: "github", TargetName: "<api url or repo url>", Requires: "-"},
+	{Type: "azure-devops", Platform: "azure-devops", TargetName: "<org>[/<project>]", Requires: "-"},
+	{Type: "gitlab", Platform: "gitlab", TargetName: "<group>[/<subgroup>]", Requires: "-"},
+}
+
+// One source per line: type, platform, target-name format and the required flags ("-" for none)
+func list_sources(w io.Writer) {
+	for _, source := range TARGET_SOURCES {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", source.Type, source.Platform, source.TargetName, source.Requires)
+	}
+}
+
+var parser = flags.NewNamedParser("repoharvester", flags.Default)
+
+// Runs without a command are harvests, so the usage from before the commands still works
+func default_command(args []string) []string {
+	if len(args) == 0 || args[0] == "-h" || parser.Find(args[0]) != nil {
+		return args
+	}
+	// Options of the parser itself, like --list-sources
+	if strings.HasPrefix(args[0], "--") && parser.FindOptionByLongName(strings.TrimPrefix(args[0], "--")) != nil {
+		return args
+	}
+	return append([]string{"harvest"}, args...)
+}
 
 func check_working_dir(working_dir string) (bool, error) {
 
@@ -360,30 +987,131 @@ func check_working_dir(working_dir string) (bool, error) {
 	return false, nil
 }
 
+// Output files created up front by check_ouput_location, the ones still empty at the end were never written
+var g_placeholders []string
+
 func check_ouput_location(file string) (bool, error) {
 
-	_, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	f, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
 
 	if err != nil {
 		return false, err
 	}
+	f.Close()
+	g_placeholders = append(g_placeholders, file)
 
 	return true, nil
 }
 
+// Removes the output files that nothing was written to so an empty harvest doesn't leave empty files behind
+func remove_empty_placeholders() int {
+	removed := 0
+	for _, file := range g_placeholders {
+		info, err := os.Stat(file)
+		if err != nil || info.Size() > 0 {
+			continue
+		}
+		if err := os.Remove(file); err != nil {
+			logger.Error("Could not remove the empty output file ", file, ". Error: ", err)
+			continue
+		}
+		logger.Debug("Removed the empty output file ", file)
+		removed++
+	}
+	return removed
+}
+
+// Says why a harvest came up without any emails, the target missing, failing to list it, no repos or no emails in them
+func report_empty_harvest() {
+	repos_listed := atomic.LoadUint32(&total_data[REMOTE_REPOS])
+	listing_errors := atomic.LoadUint32(&error_data[GITHUB_FETCH]) + atomic.LoadUint32(&error_data[GITHUB_PARSE])
+	if atomic.LoadUint32(&g_target_not_found) == 1 {
+		logger.Error("Nothing found: the target doesn't exist or isn't visible with the credentials used")
+	} else if repos_listed == 0 && listing_errors > 0 {
+		logger.Error("Nothing found: the target's repos could not be listed, see the errors above")
+	} else if repos_listed == 0 {
+		logger.Error("Nothing found: the target has no repos, or none that passed the filters")
+	} else {
+		logger.Error("Nothing found: none of the ", repos_listed, " repos listed had any emails (after the filters and the --domain-allowlist)")
+	}
+}
+
+// Parse the Link header into a map of rel -> url
+// Tolerates any ordering of the links, extra params, whitespace and multiple rels per link (rel="next last")
+func parse_link_header(http_header map[string][]string) map[string]string {
+	links := make(map[string]string)
+	for _, val := range http_header["Link"] {
+		for {
+			start := strings.IndexByte(val, '<')
+			if start < 0 {
+				break
+			}
+			end := strings.IndexByte(val[start:], '>')
+			if end < 0 {
+				break
+			}
+			link_url := strings.TrimSpace(val[start+1 : start+end])
+			val = val[start+end+1:]
+			// Params run until the start of the next link
+			params := val
+			next := strings.IndexByte(val, '<')
+			if next >= 0 {
+				params = val[:next]
+				val = val[next:]
+			} else {
+				val = ""
+			}
+			for _, param := range strings.Split(params, ";") {
+				key_value := strings.SplitN(param, "=", 2)
+				if len(key_value) != 2 || !strings.EqualFold(strings.TrimSpace(key_value[0]), "rel") {
+					continue
+				}
+				// The separator before the next link and any line breaks end up around the last value
+				for _, rel := range strings.Fields(strings.Trim(key_value[1], " \t\r\n,\"")) {
+					links[strings.ToLower(rel)] = link_url
+				}
+			}
+		}
+	}
+	return links
+}
+
 func get_next_link(http_header map[string][]string, next_url *string) bool {
-	val, ok := http_header["Link"]
+	link_url, ok := parse_link_header(http_header)["next"]
 	if ok {
-		link_header := strings.Split(val[0], ", ")
-		for _, value := range link_header {
-			if strings.HasSuffix(value, `"next"`) {
-				*next_url = strings.Split(value, "; ")[0]
-				*next_url = (*next_url)[1 : len(*next_url)-1]
-				return true
-			}
+		*next_url = link_url
+	}
+	return ok
+}
+
+// Points a listing url at the repos after the given id, for the listings paged with since=<repo id> instead of page numbers
+func since_url(page_url string, since uint64) string {
+	parsed, err := url.Parse(page_url)
+	if err != nil {
+		return page_url
+	}
+	query := parsed.Query()
+	query.Del("page")
+	query.Set("since", strconv.FormatUint(since, 10))
+	parsed.RawQuery = query.Encode()
+	return parsed.String()
+}
+
+// The highest repo id on a page of the listing and the number of repos on it
+func page_last_repo_id(data []byte) (uint64, int, error) {
+	var page []struct {
+		Id uint64
+	}
+	if err := json.Unmarshal(data, &page); err != nil {
+		return 0, 0, err
+	}
+	var last_id uint64
+	for _, repo := range page {
+		if repo.Id > last_id {
+			last_id = repo.Id
 		}
 	}
-	return false
+	return last_id, len(page), nil
 }
 
 func get_total_pages(http_header map[string][]string, total_pages *uint32) {
@@ -391,20 +1119,16 @@ func get_total_pages(http_header map[string][]string, total_pages *uint32) {
 	if *total_pages > 0 {
 		return
 	}
-	val, ok := http_header["Link"]
-	if ok {
-		link_header := strings.Split(val[0], ", ")
-		for _, value := range link_header {
-			if strings.HasSuffix(value, `"last"`) {
-				url := strings.Split(value, "; ")[0]
-				pages, err := strconv.ParseUint(url[len(url)-2:len(url)-1], 10, 32)
-				if err != nil {
-					panic(err)
-				}
+	if last_url, ok := parse_link_header(http_header)["last"]; ok {
+		parsed_url, err := url.Parse(last_url)
+		if err == nil {
+			pages, err := strconv.ParseUint(parsed_url.Query().Get("page"), 10, 32)
+			if err == nil {
 				*total_pages = uint32(pages)
 				return
 			}
 		}
+		logger.Debug("Could not read the page count from the last link: ", last_url)
 	}
 
 	// If there is no Link header, then we only have one page
@@ -412,94 +1136,578 @@ func get_total_pages(http_header map[string][]string, total_pages *uint32) {
 	return
 }
 
-func get_repos_from_github(ctx context.Context, url string) chan io.ReadCloser {
+func set_api_auth(req *http.Request, target_type string) {
+	token := api_token()
+	if len(token) == 0 {
+		return
+	}
+	if target_type == "azure-devops" {
+		// Azure DevOps takes the PAT as the basic auth password, the username is ignored
+		req.SetBasicAuth("", token)
+	} else if target_type == "gitlab" {
+		req.Header.Set("PRIVATE-TOKEN", token)
+	} else {
+		req.Header.Set("Authorization", "token "+token)
+	}
+}
+
+// Sets the User-Agent on every request the client sends, some gateways block Go's default one
+type UserAgentTransport struct {
+	transport  http.RoundTripper
+	user_agent string
+}
 
-	func_logging_name := "Stage 1 - Get Github Repos"
-	bodies := make(chan io.ReadCloser, BUFFER_SIZE)
-	c := &http.Client{}
-	urls := make(chan string, BUFFER_SIZE)
-	urls <- url
-	go func() {
-		defer close(urls)
-		defer close(bodies)
+func (user_agent *UserAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A RoundTripper must not change the caller's request
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", user_agent.user_agent)
+	return user_agent.transport.RoundTrip(req)
+}
 
-		err := g_semaphore.Acquire(ctx, 1)
-		// If we get an error back, it means the context is done
-		if err != nil {
-			return
-		}
-		defer g_semaphore.Release(1)
-		infoLogger := func() (string, bool) {
-			active := atomic.LoadUint32(&active_data[GITHUB_FETCH])
-			completed := atomic.LoadUint32(&completion_data[GITHUB_FETCH])
-			total := atomic.LoadUint32(&total_data[GITHUB_TOTAL_PAGES])
+// Logs every request and response at debug level for --verbose-http, the credentials are left out
+type LoggingTransport struct {
+	transport http.RoundTripper
+}
 
-			if active+completed+total > 0 {
-				var out strings.Builder
-				out.WriteString(func_logging_name)
-				out.WriteString(": Processed ")
-				out.WriteString(strconv.FormatUint(uint64(completed), 10))
-				out.WriteString(" of a total ")
-				out.WriteString(strconv.FormatUint(uint64(total), 10))
-				out.WriteString(" pages. Active requests: ")
-				out.WriteString(strconv.FormatUint(uint64(active), 10))
-				out.WriteString(".")
-				return out.String(), true
-			}
-			return "", false
+// Request headers that carry credentials across the platforms
+var REDACTED_HEADERS = []string{"Authorization", "Private-Token", "Cookie"}
+
+func format_headers(header http.Header) string {
+	keys := make([]string, 0, len(header))
+	for key := range header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var out strings.Builder
+	for i, key := range keys {
+		if i > 0 {
+			out.WriteString("; ")
+		}
+		out.WriteString(key)
+		out.WriteString(": ")
+		if contains_string(REDACTED_HEADERS, http.CanonicalHeaderKey(key)) {
+			out.WriteString("[REDACTED]")
+		} else {
+			out.WriteString(strings.Join(header[key], ", "))
 		}
+	}
+	return out.String()
+}
 
-		var next_url string
-		var total_pages uint32 = 0
-		for {
-			logger.DebugFunc(infoLogger)
-			select {
-			// select read from urls
-			case <-ctx.Done():
-				return
-			case url := <-urls:
-				atomic.AddUint32(&active_data[GITHUB_FETCH], 1)
-				var fetch_counter int8 = 1
+func (logging *LoggingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	func_logging_name := "HTTP"
+	start := time.Now()
+	logger.Debugf("%s: > %s %s. Headers: %s", func_logging_name, req.Method, req.URL, format_headers(req.Header))
+	resp, err := logging.transport.RoundTrip(req)
+	if err != nil {
+		logger.Debugf("%s: < %s %s failed after %v. Error: %v", func_logging_name, req.Method, req.URL, time.Since(start), err)
+		return resp, err
+	}
+	logger.Debugf("%s: < %s %s %s in %v. Headers: %s", func_logging_name, req.Method, req.URL, resp.Status, time.Since(start), format_headers(resp.Header))
+	return resp, err
+}
 
-				//run the req with the context to cancel if needed
-				req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
-				if err != nil {
-					logger.Error(func_logging_name, ": Error setting up request. Error: ", err)
-					atomic.AddUint32(&error_data[GITHUB_FETCH], 1)
-					atomic.AddUint32(&active_data[GITHUB_FETCH], ^uint32(0))
-					return
-				}
-				for {
-					resp, err := c.Do(req)
-					if err != nil {
-						if fetch_counter >= 4 {
-							logger.Errorf("%s: Error fetching %s. Error:%v", func_logging_name, url, err)
+// The --token, or the current installation token when authenticating as a GitHub App
+func api_token() string {
+	if g_app_token != nil {
+		return g_app_token.Get()
+	}
+	return API_TOKEN
+}
+
+// An installation access token of a GitHub App, minted with a JWT signed by the app's private key
+// The tokens last an hour so keep_fresh replaces them before they run out
+type AppToken struct {
+	mutex           sync.RWMutex
+	app_id          uint64
+	installation_id uint64
+	key             *rsa.PrivateKey
+	token           string
+	expires_at      time.Time
+}
+
+var g_app_token *AppToken
+
+// Replace the token this long before it expires so a request in flight never carries an expired one
+const APP_TOKEN_REFRESH_MARGIN = 5 * time.Minute
+
+func load_app_key(key_file string) (*rsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(key_file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	// GitHub hands out PKCS#1 keys, a key converted to PKCS#8 works too
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("the key isn't an RSA key")
+	}
+	return key, nil
+}
+
+// A JWT for the app itself, backdated a minute for clock drift and valid for the 10 minutes GitHub allows at most
+func (app *AppToken) jwt() (string, error) {
+	now := time.Now()
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims, err := json.Marshal(map[string]interface{}{"iat": now.Add(-time.Minute).Unix(), "exp": now.Add(9 * time.Minute).Unix(), "iss": strconv.FormatUint(app.app_id, 10)})
+	if err != nil {
+		return "", err
+	}
+	signing_input := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signing_input))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, app.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signing_input + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func (app *AppToken) refresh(ctx context.Context) error {
+	jwt, err := app.jwt()
+	if err != nil {
+		return err
+	}
+	token_url := GITHUB_API_URL + "/app/installations/" + strconv.FormatUint(app.installation_id, 10) + "/access_tokens"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, token_url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	resp, err := g_http_client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		io.Copy(ioutil.Discard, resp.Body)
+		return fmt.Errorf("%v returned %v", token_url, resp.Status)
+	}
+	var result struct {
+		Token      string
+		Expires_at time.Time
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return err
+	}
+	app.mutex.Lock()
+	app.token = result.Token
+	app.expires_at = result.Expires_at
+	app.mutex.Unlock()
+	return nil
+}
+
+func (app *AppToken) Get() string {
+	app.mutex.RLock()
+	defer app.mutex.RUnlock()
+	return app.token
+}
+
+// Refreshes the token ahead of its expiry until the harvest is done, a failed refresh is retried every 30 seconds
+func (app *AppToken) keep_fresh(ctx context.Context) {
+	func_logging_name := "GitHub App"
+	for {
+		app.mutex.RLock()
+		wait := time.Until(app.expires_at) - APP_TOKEN_REFRESH_MARGIN
+		app.mutex.RUnlock()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		if err := app.refresh(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			logger.Error(func_logging_name, ": Could not refresh the installation token, retrying. Error: ", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(30 * time.Second):
+			}
+			continue
+		}
+		logger.Info(func_logging_name, ": Refreshed the installation token")
+	}
+}
+
+// Holds back the dispatch of new work while the harvest is paused, the work already running carries on
+type PauseGate struct {
+	mutex   sync.Mutex
+	paused  bool
+	resumed chan struct{}
+}
+
+func (gate *PauseGate) pause() bool {
+	gate.mutex.Lock()
+	defer gate.mutex.Unlock()
+	if gate.paused {
+		return false
+	}
+	gate.paused = true
+	gate.resumed = make(chan struct{})
+	return true
+}
+
+func (gate *PauseGate) resume() bool {
+	gate.mutex.Lock()
+	defer gate.mutex.Unlock()
+	if !gate.paused {
+		return false
+	}
+	gate.paused = false
+	close(gate.resumed)
+	return true
+}
+
+// Blocks until the harvest is resumed, the error is from the context
+func (gate *PauseGate) wait(ctx context.Context) error {
+	gate.mutex.Lock()
+	if !gate.paused {
+		gate.mutex.Unlock()
+		return nil
+	}
+	resumed := gate.resumed
+	gate.mutex.Unlock()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-resumed:
+		return nil
+	}
+}
+
+var g_pause PauseGate
+
+// Pauses and resumes the harvest on PAUSE_SIGNAL and RESUME_SIGNAL until the context is done
+func handle_pause_signals(ctx context.Context) {
+	if PAUSE_SIGNAL == nil {
+		return
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, PAUSE_SIGNAL, RESUME_SIGNAL)
+	go func() {
+		defer signal.Stop(signals)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case sig := <-signals:
+				if sig == PAUSE_SIGNAL && g_pause.pause() {
+					logger.Info("Paused, no new clones or shortlogs will start until resumed with kill -CONT ", os.Getpid(), ". The ones running will finish.")
+				} else if sig == RESUME_SIGNAL && g_pause.resume() {
+					logger.Info("Resumed")
+				}
+			}
+		}
+	}()
+}
+
+// A git operation holding a worker, watched for --stall-warning and --stall-kill
+type WatchedWork struct {
+	stage   string
+	name    string
+	started time.Time
+	cancel  context.CancelFunc
+	warned  bool
+	killed  bool
+}
+
+type Watchdog struct {
+	mutex   sync.Mutex
+	enabled bool
+	next    uint64
+	work    map[uint64]*WatchedWork
+}
+
+var g_watchdog = Watchdog{work: make(map[uint64]*WatchedWork)}
+
+// How often the watchdog looks over the running work
+const WATCHDOG_INTERVAL = 10 * time.Second
+
+// The git commands of the work run with the returned context so --stall-kill can stop them
+// done can be called more than once, it is called early when the work goes on to wait on a queue
+func (watchdog *Watchdog) watch(ctx context.Context, stage string, name string) (context.Context, func()) {
+	if !watchdog.enabled {
+		return ctx, func() {}
+	}
+	work_ctx, cancel := context.WithCancel(ctx)
+	watchdog.mutex.Lock()
+	id := watchdog.next
+	watchdog.next++
+	watchdog.work[id] = &WatchedWork{stage: stage, name: name, started: time.Now(), cancel: cancel}
+	watchdog.mutex.Unlock()
+	return work_ctx, func() {
+		watchdog.mutex.Lock()
+		delete(watchdog.work, id)
+		watchdog.mutex.Unlock()
+		cancel()
+	}
+}
+
+// Warns once about each operation held longer than warn_after and kills the ones held longer than kill_after, 0 turns either off
+func (watchdog *Watchdog) run(ctx context.Context, warn_after time.Duration, kill_after time.Duration) {
+	watchdog.enabled = warn_after > 0 || kill_after > 0
+	if !watchdog.enabled {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(WATCHDOG_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				watchdog.mutex.Lock()
+				for _, work := range watchdog.work {
+					held := now.Sub(work.started).Round(time.Second)
+					if kill_after > 0 && held >= kill_after && !work.killed {
+						work.killed = true
+						logger.Error("Watchdog: Killing the ", work.stage, " of ", work.name, " after holding a worker for ", held)
+						work.cancel()
+					} else if warn_after > 0 && held >= warn_after && !work.warned {
+						work.warned = true
+						logger.Error("Watchdog: The ", work.stage, " of ", work.name, " has held a worker for ", held, ", it may be stuck")
+					}
+				}
+				watchdog.mutex.Unlock()
+			}
+		}
+	}()
+}
+
+// Takes a g_live_work slot and then a g_semaphore permit, always in that order
+func acquire_work(ctx context.Context) error {
+	if err := g_live_work.Acquire(ctx, 1); err != nil {
+		return err
+	}
+	if err := g_semaphore.Acquire(ctx, 1); err != nil {
+		g_live_work.Release(1)
+		return err
+	}
+	return nil
+}
+
+func release_work() {
+	g_semaphore.Release(1)
+	g_live_work.Release(1)
+}
+
+// Waits FETCH_BACKOFF times the attempt number, false if the context finished first
+func retry_backoff(ctx context.Context, attempt int) bool {
+	if FETCH_BACKOFF <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(FETCH_BACKOFF * time.Duration(attempt))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// Reads the whole page so a connection dropped mid-body is retried by the fetch rather than failing the parse
+// Server errors are retried too, the 4xx error objects are passed on for the parse to report
+func read_page_body(resp *http.Response) (io.ReadCloser, error) {
+	defer resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return nil, fmt.Errorf("server error %s", resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.ContentLength >= 0 && int64(len(data)) != resp.ContentLength {
+		return nil, fmt.Errorf("read %d of %d bytes of the page", len(data), resp.ContentLength)
+	}
+	if !json.Valid(data) {
+		return nil, errors.New("the page is not complete JSON")
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// With since_paging the next page is asked for by the last repo id seen rather than the Link header, the listing ends on an empty page
+func get_repos_from_github(ctx context.Context, start_urls []string, target_type string, since_paging bool) chan io.ReadCloser {
+
+	func_logging_name := "Stage 1 - Get Github Repos"
+	bodies := make(chan io.ReadCloser, PAGE_BUFFER_SIZE)
+	c := g_http_client
+	// Azure DevOps returns every repo in one response, so there is only a single page to pull
+	paginate := target_type != "azure-devops"
+	urls := make(chan string, BUFFER_SIZE)
+	urls <- start_urls[0]
+	go func() {
+		defer close(urls)
+		defer close(bodies)
+
+		err := g_semaphore.Acquire(ctx, 1)
+		// If we get an error back, it means the context is done
+		if err != nil {
+			return
+		}
+		defer g_semaphore.Release(1)
+		infoLogger := func() (string, bool) {
+			active := atomic.LoadUint32(&active_data[GITHUB_FETCH])
+			completed := atomic.LoadUint32(&completion_data[GITHUB_FETCH])
+			total := atomic.LoadUint32(&total_data[GITHUB_TOTAL_PAGES])
+
+			if active+completed+total > 0 {
+				var out strings.Builder
+				out.WriteString(func_logging_name)
+				out.WriteString(": Processed ")
+				out.WriteString(strconv.FormatUint(uint64(completed), 10))
+				out.WriteString(" of a total ")
+				out.WriteString(strconv.FormatUint(uint64(total), 10))
+				out.WriteString(" pages. Active requests: ")
+				out.WriteString(strconv.FormatUint(uint64(active), 10))
+				out.WriteString(".")
+				return out.String(), true
+			}
+			return "", false
+		}
+
+		var next_url string
+		var total_pages uint32 = 0
+		// Pages of the target currently being pulled, a target's page count is added to the total on its first page
+		var target_pages uint32 = 0
+		// Last repo id of the target handed to since=, a page has to move past it
+		var last_since uint64 = 0
+		target_index := 0
+		// Queue up the next target once the current one is done or failed, false when there are none left
+		next_target := func() bool {
+			target_index++
+			if target_index >= len(start_urls) {
+				logger.Info(func_logging_name, ": Completed. Pages pulled: ", total_pages, ". Error count: ", atomic.LoadUint32(&error_data[GITHUB_FETCH]))
+				return false
+			}
+			target_pages = 0
+			last_since = 0
+			// This should never block
+			urls <- start_urls[target_index]
+			return true
+		}
+		for {
+			logger.DebugFunc(infoLogger)
+			select {
+			// select read from urls
+			case <-ctx.Done():
+				return
+			case url := <-urls:
+				atomic.AddUint32(&active_data[GITHUB_FETCH], 1)
+				fetch_counter := 1
+				fetch_start := time.Now()
+
+				//run the req with the context to cancel if needed
+				req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+				if err != nil {
+					logger.Error(func_logging_name, ": Error setting up request. Error: ", err)
+					g_failures.add(func_logging_name, nil, url, err, "")
+					atomic.AddUint32(&error_data[GITHUB_FETCH], 1)
+					atomic.AddUint32(&active_data[GITHUB_FETCH], ^uint32(0))
+					if !next_target() {
+						return
+					}
+					continue
+				}
+				set_api_auth(req, target_type)
+				for {
+					// Every attempt counts against the API, including retries
+					if err := g_api_limiter.Wait(ctx); err != nil {
+						atomic.AddUint32(&active_data[GITHUB_FETCH], ^uint32(0))
+						return
+					}
+					attempt_start := time.Now()
+					resp, err := c.Do(req)
+					var body io.ReadCloser
+					if err == nil {
+						body, err = read_page_body(resp)
+					}
+					g_fetch_log.add(url, attempt_start, fetch_counter-1, resp, err)
+					if err != nil {
+						if fetch_counter > FETCH_RETRIES {
+							logger.Errorf("%s: Error fetching %s. Error:%v", func_logging_name, url, err)
+							g_failures.add(func_logging_name, nil, url, err, "")
 							atomic.AddUint32(&error_data[GITHUB_FETCH], 1)
 							atomic.AddUint32(&active_data[GITHUB_FETCH], ^uint32(0))
-							return
+							if !next_target() {
+								return
+							}
+							break
 						} else {
 							logger.Debugf("%s: Attempt #%d. URL: %s. Error: %v", func_logging_name, fetch_counter, url, err)
+							if !retry_backoff(ctx, fetch_counter) {
+								atomic.AddUint32(&active_data[GITHUB_FETCH], ^uint32(0))
+								return
+							}
 							fetch_counter++
 							continue
 						}
 					}
-					get_total_pages(resp.Header, &total_pages)
+					// The client follows the redirect of a renamed target, the pages after it come from the new location
+					if final_url := resp.Request.URL.String(); final_url != url {
+						logger.Info(func_logging_name, ": ", url, " was redirected to ", final_url)
+						if target_pages == 0 && (target_type == "users" || target_type == "orgs") {
+							resolve_rename(ctx, url, resp.Request.URL)
+						}
+					}
+					if target_pages == 0 {
+						get_total_pages(resp.Header, &target_pages)
+						total_pages += target_pages
+					}
+					var last_id uint64
+					since_more := false
+					if since_paging {
+						// The body is already in memory, read it to find where the next page starts
+						data, _ := ioutil.ReadAll(body)
+						body = ioutil.NopCloser(bytes.NewReader(data))
+						var count int
+						if last_id, count, err = page_last_repo_id(data); err == nil && count > 0 {
+							if last_id > last_since {
+								since_more = true
+								// The page count isn't known up front, each page adds the next one
+								total_pages++
+							} else {
+								logger.Error(func_logging_name, ": ", url, " did not move past repo id ", last_since, ", the listing may not support --since-paging")
+								atomic.AddUint32(&error_data[GITHUB_FETCH], 1)
+							}
+						}
+					}
 					atomic.StoreUint32(&total_data[GITHUB_TOTAL_PAGES], total_pages)
 					atomic.AddUint32(&completion_data[GITHUB_FETCH], 1)
+					g_trace.add("fetch", url, fetch_start)
 					atomic.AddUint32(&active_data[GITHUB_FETCH], ^uint32(0))
 					// select write to bodies
 					select {
 					case <-ctx.Done():
 						return
-					case bodies <- resp.Body:
+					case bodies <- body:
 					}
 
-					ok := get_next_link(resp.Header, &next_url)
-					if ok {
+					if since_paging && since_more {
+						last_since = last_id
+						// This should never block
+						urls <- since_url(resp.Request.URL.String(), last_id)
+					} else if ok := !since_paging && paginate && get_next_link(resp.Header, &next_url); ok {
+						// Resolve against where the page really came from so a redirect doesn't mix the old and new hosts
+						if next, err := resp.Request.URL.Parse(next_url); err == nil {
+							next_url = next.String()
+						}
 						// This should never block
 						urls <- next_url
-					} else {
-						logger.Info(func_logging_name, ": Completed. Pages pulled: ", total_pages, ". Error count: ", atomic.LoadUint32(&error_data[GITHUB_FETCH]))
+					} else if !next_target() {
 						return
 					}
 					break
@@ -510,11 +1718,70 @@ func get_repos_from_github(ctx context.Context, url string) chan io.ReadCloser {
 	return bodies
 }
 
-func parse_github_response(ctx context.Context, repo_data chan io.ReadCloser, fork_filter bool) chan Repo {
+// Decode a page of repos, Azure DevOps wraps the list in an object
+// An error object from the API comes back as an *ApiError rather than a parse failure
+func decode_repos(dec *json.Decoder, target_type string) ([]Repo, error) {
+	if target_type != "azure-devops" {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return nil, err
+		}
+		if trimmed := bytes.TrimSpace(raw); len(trimmed) > 0 && trimmed[0] == '{' {
+			api_err := &ApiError{}
+			if err := json.Unmarshal(raw, api_err); err != nil || len(api_err.Message) == 0 {
+				return nil, errors.New("expected a list of repos but got an object")
+			}
+			return nil, api_err
+		}
+		if target_type == "gitlab" {
+			var projects []GitlabProject
+			if err := json.Unmarshal(raw, &projects); err != nil {
+				return nil, err
+			}
+			r := make([]Repo, 0, len(projects))
+			for _, project := range projects {
+				// Project names repeat across subgroups, the full path doesn't
+				// GitLab only reports sizes to members, so these aren't size filtered
+				r = append(r, Repo{Id: project.Id, Name: project.Path_with_namespace, Clone_url: project.Http_url_to_repo, Fork: project.Forked_from_project != nil, Owner: RepoOwner{Login: project.Namespace.Full_path}, Stargazers_count: project.Star_count, Private: project.Visibility != "public", Topics: project.Topics, Description: project.Description})
+			}
+			return r, nil
+		}
+		var r []Repo
+		err := json.Unmarshal(raw, &r)
+		return r, err
+	}
+	var azure_repos AzureRepoList
+	if err := dec.Decode(&azure_repos); err != nil {
+		return nil, err
+	}
+	if azure_repos.Value == nil && len(azure_repos.Message) > 0 {
+		return nil, &ApiError{Message: azure_repos.Message}
+	}
+	r := make([]Repo, 0, len(azure_repos.Value))
+	for _, azure_repo := range azure_repos.Value {
+		r = append(r, Repo{Name: azure_repo.Name, Clone_url: azure_repo.RemoteUrl, Size: azure_repo.Size / 1024, Fork: azure_repo.IsFork})
+	}
+	return r, nil
+}
+
+// Checks the repo has one of the topics, the filters hold them lower cased
+func repo_has_topic(repo *Repo, topics map[string]bool) bool {
+	for _, topic := range repo.Topics {
+		if topics[strings.ToLower(topic)] {
+			return true
+		}
+	}
+	return false
+}
+
+func parse_github_response(ctx context.Context, repo_data chan io.ReadCloser, fork_filter bool, mirror_filter bool, owner_filter map[string]bool, min_stars uint32, target_type string, topic_filter map[string]bool, topic_exclude map[string]bool) chan Repo {
 	func_logging_name := "Stage 2 - Parse URLs"
-	repos := make(chan Repo, BUFFER_SIZE)
+	repos := make(chan Repo, REPO_BUFFER_SIZE)
 	go func() {
 		var wg sync.WaitGroup
+		var owner_skipped uint32
+		var topic_skipped uint32
+		var mirror_skipped uint32
 		infoLogger := func() (string, bool) {
 			active := atomic.LoadUint32(&active_data[GITHUB_PARSE])
 			completed := atomic.LoadUint32(&completion_data[GITHUB_PARSE])
@@ -548,9 +1815,18 @@ func parse_github_response(ctx context.Context, repo_data chan io.ReadCloser, fo
 					wg.Wait()
 					close(repos)
 					logger.Info(func_logging_name, ": Completed. Total Pages Parsed: ", atomic.LoadUint32(&completion_data[GITHUB_PARSE]), ". Work Items Created: ", atomic.LoadUint32(&total_data[REMOTE_REPOS]), ". Error count: ", atomic.LoadUint32(&error_data[GITHUB_PARSE]))
+					if len(owner_filter) > 0 {
+						logger.Info(func_logging_name, ": Skipped ", atomic.LoadUint32(&owner_skipped), " repos not owned by the target.")
+					}
+					if mirror_filter {
+						logger.Info(func_logging_name, ": Skipped ", atomic.LoadUint32(&mirror_skipped), " mirror repos.")
+					}
+					if len(topic_filter)+len(topic_exclude) > 0 {
+						logger.Info(func_logging_name, ": Skipped ", atomic.LoadUint32(&topic_skipped), " repos based on their topics.")
+					}
 					return
 				}
-				err := g_semaphore.Acquire(ctx, 1)
+				err := acquire_work(ctx)
 				// If we get an error back, it means the context is done
 				if err != nil {
 					wg.Wait()
@@ -561,15 +1837,25 @@ func parse_github_response(ctx context.Context, repo_data chan io.ReadCloser, fo
 				atomic.AddUint32(&active_data[GITHUB_PARSE], 1)
 				go func(body io.ReadCloser) {
 					defer wg.Done()
-					defer g_semaphore.Release(1)
+					defer release_work()
+					defer g_trace.add("parse", "", time.Now())
 					dec := json.NewDecoder(body)
 					for {
-						var r []Repo
-						if err := dec.Decode(&r); err == io.EOF {
+						r, err := decode_repos(dec, target_type)
+						if err == io.EOF {
 							body.Close()
 							break
 						} else if err != nil {
-							logger.Error(func_logging_name, ": Error parsing body. Error: ", err)
+							body.Close()
+							if api_err, ok := err.(*ApiError); ok && api_err.NotFound() {
+								atomic.StoreUint32(&g_target_not_found, 1)
+								logger.Error(func_logging_name, ": The target was not found. Check the target name and type, private targets also need a --token")
+							} else if ok {
+								logger.Error(func_logging_name, ": The API returned an error: ", api_err.Message)
+							} else {
+								logger.Error(func_logging_name, ": Error parsing body. Error: ", err)
+							}
+							g_failures.add(func_logging_name, nil, "", err, "")
 							atomic.AddUint32(&error_data[GITHUB_PARSE], 1)
 							atomic.AddUint32(&active_data[GITHUB_PARSE], ^uint32(0))
 							// Not sure if I should continue or just exit.
@@ -581,6 +1867,26 @@ func parse_github_response(ctx context.Context, repo_data chan io.ReadCloser, fo
 								logger.Debug(func_logging_name, ": Skipping ", repo.Name, " based on the fork filter.")
 								continue
 							}
+							if len(repo.Mirror_url) > 0 && mirror_filter {
+								logger.Debug(func_logging_name, ": Skipping ", repo.Name, " mirrored from ", repo.Mirror_url, " based on the mirror filter.")
+								atomic.AddUint32(&mirror_skipped, 1)
+								continue
+							}
+							// Logins are case insensitive, the filter holds them lower cased
+							if len(owner_filter) > 0 && !owner_filter[strings.ToLower(repo.Owner.Login)] && !g_renames.RenamedTo(repo.Owner.Login) {
+								logger.Debug(func_logging_name, ": Skipping ", repo.Name, " owned by ", repo.Owner.Login, " based on the owner filter.")
+								atomic.AddUint32(&owner_skipped, 1)
+								continue
+							}
+							if repo.Stargazers_count < min_stars {
+								logger.Debug(func_logging_name, ": Skipping ", repo.Name, " with ", repo.Stargazers_count, " stars based on the star filter.")
+								continue
+							}
+							if (len(topic_filter) > 0 && !repo_has_topic(&repo, topic_filter)) || repo_has_topic(&repo, topic_exclude) {
+								logger.Debug(func_logging_name, ": Skipping ", repo.Name, " with topics [", strings.Join(repo.Topics, ", "), "] based on the topic filter.")
+								atomic.AddUint32(&topic_skipped, 1)
+								continue
+							}
 							select {
 							case <-ctx.Done():
 								return
@@ -594,31 +1900,647 @@ func parse_github_response(ctx context.Context, repo_data chan io.ReadCloser, fo
 				}(body)
 			}
 		}
-		wg.Wait()
-		close(repos)
 	}()
 
 	return repos
 }
 
-func git_ops_clone(ctx context.Context, repos chan Repo, git_path *string, working_dir *string, size_filter uint64) chan Repo {
-	local_repos := make(chan Repo, BUFFER_SIZE)
-	func_logging_name := "Stage 3 - Clone Repos"
-	go func() {
-		var wg sync.WaitGroup
-		infoLogger := func() (string, bool) {
-			active := atomic.LoadUint32(&active_data[GIT_OPS_CLONE])
-			completed := atomic.LoadUint32(&completion_data[GIT_OPS_CLONE])
-			total := atomic.LoadUint32(&total_data[REMOTE_REPOS])
-
-			if active+completed+total > 0 && completed%3 == 0 {
-				var out strings.Builder
-				out.WriteString(func_logging_name)
-				out.WriteString(": Cloned ")
-				out.WriteString(strconv.FormatUint(uint64(completed), 10))
-				out.WriteString(" of a total ")
-				out.WriteString(strconv.FormatUint(uint64(total), 10))
-				out.WriteString(" repos. Active clones: ")
+// GET every page of an API listing, following the Link header, and hand each body to handle_page
+// Endpoints with their own rate limits (like search) pass an extra_limiter on top of the global one
+func fetch_api_pages(ctx context.Context, page_url string, target_type string, extra_limiter *rate.Limiter, handle_page func(*json.Decoder) error) error {
+	for len(page_url) > 0 {
+		if extra_limiter != nil {
+			if err := extra_limiter.Wait(ctx); err != nil {
+				return err
+			}
+		}
+		if err := g_api_limiter.Wait(ctx); err != nil {
+			return err
+		}
+		req, err := http.NewRequestWithContext(ctx, "GET", page_url, nil)
+		if err != nil {
+			return err
+		}
+		set_api_auth(req, target_type)
+		resp, err := g_http_client.Do(req)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return fmt.Errorf("%s returned %s", page_url, resp.Status)
+		}
+		err = handle_page(json.NewDecoder(resp.Body))
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		if !get_next_link(resp.Header, &page_url) {
+			page_url = ""
+		}
+	}
+	return nil
+}
+
+type GithubRateLimit struct {
+	Resources struct {
+		Core struct {
+			Limit     int
+			Remaining int
+			Reset     int64
+		}
+	}
+}
+
+// GET a GitHub API endpoint and decode the body into value
+// The response is returned for its headers, the body is already closed
+func get_github_api(ctx context.Context, api_url string, value interface{}) (*http.Response, error) {
+	if err := g_api_limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, api_url, nil)
+	if err != nil {
+		return nil, err
+	}
+	set_api_auth(req, "")
+	resp, err := g_http_client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return resp, fmt.Errorf("%v returned %v", api_url, resp.Status)
+	}
+	return resp, json.NewDecoder(resp.Body).Decode(value)
+}
+
+// Look up the canonical name of a target whose repo listing was redirected
+// GitHub sends a renamed target to e.g. /organizations/<id>/repos, the account itself is the same path without /repos
+func resolve_rename(ctx context.Context, start_url string, final_url *url.URL) {
+	func_logging_name := "Stage 1 - Get Github Repos"
+	start, err := url.Parse(start_url)
+	if err != nil {
+		return
+	}
+	old_name := path.Base(strings.TrimSuffix(start.Path, "/repos"))
+	account_url := *final_url
+	account_url.Path = strings.TrimSuffix(final_url.Path, "/repos")
+	account_url.RawQuery = ""
+	var account RepoOwner
+	if _, err := get_github_api(ctx, account_url.String(), &account); err != nil || len(account.Login) == 0 {
+		logger.Error(func_logging_name, ": Could not look up the new name of ", old_name, ". Error: ", err)
+		return
+	}
+	if !strings.EqualFold(account.Login, old_name) {
+		logger.Info(func_logging_name, ": ", old_name, " was renamed to ", account.Login)
+		g_renames.add(old_name, account.Login)
+	}
+}
+
+// Check the token works and that there is API budget left before the pipeline starts
+// Without this a bad token shows up as JSON decode errors in the parse stage
+func check_github_auth(ctx context.Context) error {
+	func_logging_name := "Auth Check"
+	if g_app_token != nil {
+		// Installation tokens can't read /user
+		logger.Info(func_logging_name, ": Authenticated as installation ", g_app_token.installation_id, " of GitHub App ", g_app_token.app_id)
+	} else if len(API_TOKEN) > 0 {
+		var user RepoOwner
+		resp, err := get_github_api(ctx, GITHUB_API_URL+"/user", &user)
+		if err != nil {
+			if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+				return errors.New("the token was rejected. Check that it hasn't expired or been revoked")
+			}
+			if resp != nil && resp.StatusCode == http.StatusForbidden && len(resp.Header.Get("X-GitHub-SSO")) > 0 {
+				return errors.New("the token has to be authorized for the org's SAML SSO: " + resp.Header.Get("X-GitHub-SSO"))
+			}
+			return err
+		}
+		logger.Info(func_logging_name, ": Authenticated as ", user.Login)
+		// Only classic tokens report their scopes
+		if scopes := resp.Header.Get("X-OAuth-Scopes"); len(scopes) > 0 {
+			logger.Info(func_logging_name, ": Token scopes: ", scopes)
+		}
+	}
+	var rate_limit GithubRateLimit
+	if _, err := get_github_api(ctx, GITHUB_API_URL+"/rate_limit", &rate_limit); err != nil {
+		return err
+	}
+	core := rate_limit.Resources.Core
+	reset := time.Unix(core.Reset, 0).Format(time.RFC3339)
+	logger.Info(func_logging_name, ": API budget ", core.Remaining, " of ", core.Limit, " requests, resets at ", reset)
+	if core.Remaining == 0 {
+		return errors.New("the API budget is used up until " + reset)
+	}
+	return nil
+}
+
+// Works out whether a url target is a single repo rather than a repo listing
+// Web urls (https://<host>/<owner>/<repo>) and API urls (.../repos/<owner>/<repo>) are both accepted
+func single_repo_urls(target string) (api_url string, clone_url string, owner string, name string, ok bool) {
+	parsed, err := url.Parse(target)
+	if err != nil || len(parsed.Host) == 0 {
+		return "", "", "", "", false
+	}
+	segments := strings.Split(strings.Trim(strings.TrimSuffix(parsed.Path, ".git"), "/"), "/")
+	host := parsed.Scheme + "://" + parsed.Host
+	web_host := host
+	api_base := host + "/api/v3"
+	if parsed.Host == "github.com" || parsed.Host == "api.github.com" {
+		web_host = parsed.Scheme + "://github.com"
+		api_base = parsed.Scheme + "://api.github.com"
+	}
+	count := len(segments)
+	switch {
+	case count >= 3 && segments[count-3] == "repos":
+		owner, name = segments[count-2], segments[count-1]
+	case count == 2 && parsed.Host != "api.github.com" && segments[1] != "repos":
+		owner, name = segments[0], segments[1]
+	default:
+		return "", "", "", "", false
+	}
+	return api_base + "/repos/" + owner + "/" + name, web_host + "/" + owner + "/" + name + ".git", owner, name, true
+}
+
+// Stands in for the fetch stage when the target is a single repo
+// The repo is looked up so the size and fork filters work the same as the other modes, falling back to cloning blindly
+func get_single_repo(ctx context.Context, target string, target_type string) chan io.ReadCloser {
+	func_logging_name := "Stage 1 - Get Github Repos"
+	bodies := make(chan io.ReadCloser, 1)
+	api_url, clone_url, owner, name, _ := single_repo_urls(target)
+	atomic.AddUint32(&total_data[GITHUB_TOTAL_PAGES], 1)
+	go func() {
+		defer close(bodies)
+		defer g_trace.add("fetch", api_url, time.Now())
+		var page []byte
+		var repo json.RawMessage
+		resp, err := get_github_api(ctx, api_url, &repo)
+		if resp != nil {
+			logger.Debug(func_logging_name, ": Lookup of ", api_url, " returned ", resp.Status)
+		}
+		if err == nil {
+			page = append(append([]byte("["), repo...), ']')
+		} else {
+			logger.Error(func_logging_name, ": Could not look up ", api_url, ", cloning ", clone_url, " without the size. Error: ", err)
+			page, _ = json.Marshal([]Repo{{Name: name, Clone_url: clone_url, Owner: RepoOwner{Login: owner}}})
+		}
+		atomic.AddUint32(&completion_data[GITHUB_FETCH], 1)
+		select {
+		case <-ctx.Done():
+		case bodies <- ioutil.NopCloser(bytes.NewReader(page)):
+		}
+	}()
+	return bodies
+}
+
+const GITHUB_GRAPHQL_URL string = "https://api.github.com/graphql"
+
+const ENTERPRISE_ORGS_QUERY string = `query($slug: String!, $cursor: String) {
+  enterprise(slug: $slug) {
+    organizations(first: 100, after: $cursor) {
+      nodes { login }
+      pageInfo { hasNextPage endCursor }
+    }
+  }
+}`
+
+type EnterpriseOrgsResponse struct {
+	Data struct {
+		Enterprise *struct {
+			Organizations struct {
+				Nodes    []SearchAccount
+				PageInfo struct {
+					HasNextPage bool
+					EndCursor   string
+				}
+			}
+		}
+	}
+	Errors []struct {
+		Type    string
+		Message string
+	}
+}
+
+// POST a query to the GraphQL API and decode the response into result, the errors in the body are left to the caller
+func post_graphql(ctx context.Context, query string, variables map[string]interface{}, result interface{}) error {
+	body, err := json.Marshal(map[string]interface{}{"query": query, "variables": variables})
+	if err != nil {
+		return err
+	}
+	if err := g_api_limiter.Wait(ctx); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, GITHUB_GRAPHQL_URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	// GraphQL only takes bearer auth
+	req.Header.Set("Authorization", "bearer "+api_token())
+	resp, err := g_http_client.Do(req)
+	if err != nil {
+		return err
+	}
+	err = json.NewDecoder(resp.Body).Decode(result)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", GITHUB_GRAPHQL_URL, resp.Status)
+	}
+	return err
+}
+
+// Lists the logins of every org in an enterprise through the GraphQL API, the REST API has no equivalent
+func resolve_enterprise_orgs(ctx context.Context, slug string) ([]string, error) {
+	func_logging_name := "Enterprise"
+	var logins []string
+	variables := map[string]interface{}{"slug": slug, "cursor": nil}
+	for {
+		var result EnterpriseOrgsResponse
+		if err := post_graphql(ctx, ENTERPRISE_ORGS_QUERY, variables, &result); err != nil {
+			return nil, err
+		}
+		if len(result.Errors) > 0 {
+			if result.Errors[0].Type == "INSUFFICIENT_SCOPES" {
+				return nil, errors.New("the token needs the read:enterprise scope (and read:org to list the repos)")
+			}
+			return nil, errors.New(result.Errors[0].Message)
+		}
+		if result.Data.Enterprise == nil {
+			return nil, fmt.Errorf("enterprise %s not found", slug)
+		}
+		organizations := result.Data.Enterprise.Organizations
+		for _, org := range organizations.Nodes {
+			logins = append(logins, org.Login)
+		}
+		if !organizations.PageInfo.HasNextPage {
+			break
+		}
+		variables["cursor"] = organizations.PageInfo.EndCursor
+	}
+	logger.Info(func_logging_name, ": ", len(logins), " orgs found in ", slug, ": ", strings.Join(logins, ", "))
+	return logins, nil
+}
+
+type SearchAccount struct {
+	Login string
+	Type  string
+}
+
+type SearchResults struct {
+	Total_count uint32
+	Items       []SearchAccount
+}
+
+// The search API only returns the first 1000 results of a query
+const SEARCH_RESULT_LIMIT uint32 = 1000
+
+// Resolve a search into the logins of the matching orgs or users
+// A query with * wildcards (acme-*) searches on its longest literal part and keeps the logins matching the pattern
+func resolve_search_targets(ctx context.Context, query string, target_type string) ([]string, error) {
+	func_logging_name := "Search"
+	account_type := "org"
+	if target_type == "users" {
+		account_type = "user"
+	}
+	pattern := strings.ToLower(query)
+	term := query
+	if strings.Contains(query, "*") {
+		term = ""
+		for _, part := range strings.Split(query, "*") {
+			if len(part) > len(term) {
+				term = part
+			}
+		}
+		if len(term) == 0 {
+			return nil, errors.New("the search needs some text besides wildcards")
+		}
+	}
+	// The search API allows 30 requests a minute with a token and 10 without
+	search_limiter := rate.NewLimiter(rate.Every(time.Minute/10), 1)
+	if len(api_token()) > 0 {
+		search_limiter = rate.NewLimiter(rate.Every(time.Minute/30), 1)
+	}
+	search_url := GITHUB_API_URL + "/search/users?per_page=" + strconv.Itoa(PER_PAGE) + "&q=" + url.QueryEscape(term+" in:login type:"+account_type)
+	var logins []string
+	err := fetch_api_pages(ctx, search_url, target_type, search_limiter, func(dec *json.Decoder) error {
+		var results SearchResults
+		if err := dec.Decode(&results); err != nil {
+			return err
+		}
+		if results.Total_count > SEARCH_RESULT_LIMIT && len(logins) == 0 {
+			logger.Error(func_logging_name, ": ", results.Total_count, " accounts matched but the API only returns the first ", SEARCH_RESULT_LIMIT, ". Narrow the search.")
+		}
+		for _, account := range results.Items {
+			if strings.Contains(pattern, "*") {
+				if matched, _ := path.Match(pattern, strings.ToLower(account.Login)); !matched {
+					logger.Debug(func_logging_name, ": Skipping ", account.Login, " as it doesn't match ", query)
+					continue
+				}
+			}
+			logins = append(logins, account.Login)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	logger.Info(func_logging_name, ": ", len(logins), " accounts matched ", query, ": ", strings.Join(logins, ", "))
+	return logins, nil
+}
+
+// Lists the members of each org, deduped across them. Without a token of an org member only the public members are returned
+func resolve_org_members(ctx context.Context, orgs []string) ([]string, error) {
+	func_logging_name := "Members"
+	seen := make(map[string]bool)
+	var logins []string
+	for _, org := range orgs {
+		members_url := GITHUB_API_URL + "/orgs/" + url.PathEscape(org) + "/members?per_page=" + strconv.Itoa(PER_PAGE)
+		count := 0
+		err := fetch_api_pages(ctx, members_url, "orgs", nil, func(dec *json.Decoder) error {
+			var members []RepoOwner
+			if err := dec.Decode(&members); err != nil {
+				return err
+			}
+			for _, member := range members {
+				count++
+				if !seen[strings.ToLower(member.Login)] {
+					seen[strings.ToLower(member.Login)] = true
+					logins = append(logins, member.Login)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		logger.Info(func_logging_name, ": ", count, " members found in ", org)
+	}
+	return logins, nil
+}
+
+// Pass the repos through and add the forks of each one so their contributors are harvested too
+func expand_forks(ctx context.Context, repos chan Repo, target_type string) chan Repo {
+	func_logging_name := "Stage 2b - Expand Forks"
+	expanded_repos := make(chan Repo, REPO_BUFFER_SIZE)
+	go func() {
+		defer close(expanded_repos)
+		var forks_added uint32
+		var fork_errors uint32
+		for repo := range repos {
+			select {
+			case <-ctx.Done():
+				return
+			case expanded_repos <- repo:
+			}
+			if repo.Forks_count == 0 || len(repo.Forks_url) == 0 {
+				continue
+			}
+			err := fetch_api_pages(ctx, repo.Forks_url+"?per_page="+strconv.Itoa(PER_PAGE), target_type, nil, func(dec *json.Decoder) error {
+				var forks []Repo
+				if err := dec.Decode(&forks); err != nil {
+					return err
+				}
+				for _, fork := range forks {
+					// Forks keep the source's name, so qualify it with the owner
+					fork.Name = fork.Owner.Login + "/" + fork.Name
+					select {
+					case <-ctx.Done():
+						return ctx.Err()
+					case expanded_repos <- fork:
+						atomic.AddUint32(&total_data[REMOTE_REPOS], 1)
+						forks_added++
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				fork_errors++
+				logger.Error(func_logging_name, ": Error listing the forks of ", repo.Name, ". Error: ", err)
+			}
+		}
+		logger.Info(func_logging_name, ": Completed. Forks added: ", forks_added, ". Error count: ", fork_errors)
+	}()
+	return expanded_repos
+}
+
+// Adds the wiki of each repo with one enabled after the repo itself
+func expand_wikis(ctx context.Context, repos chan Repo) chan Repo {
+	func_logging_name := "Stage 2c - Expand Wikis"
+	expanded_repos := make(chan Repo, REPO_BUFFER_SIZE)
+	go func() {
+		defer close(expanded_repos)
+		var wikis_added uint32
+		for repo := range repos {
+			select {
+			case <-ctx.Done():
+				return
+			case expanded_repos <- repo:
+			}
+			if !repo.Has_wiki || !strings.HasSuffix(repo.Clone_url, ".git") {
+				continue
+			}
+			wiki := Repo{Name: repo.Name + ".wiki", Clone_url: strings.TrimSuffix(repo.Clone_url, ".git") + ".wiki.git", Owner: repo.Owner, Private: repo.Private, wiki: true}
+			select {
+			case <-ctx.Done():
+				return
+			case expanded_repos <- wiki:
+				atomic.AddUint32(&total_data[REMOTE_REPOS], 1)
+				wikis_added++
+			}
+		}
+		logger.Info(func_logging_name, ": Completed. Wikis added: ", wikis_added)
+	}()
+	return expanded_repos
+}
+
+// Environment for the clone commands
+// Prompts would hold a worker forever, so git is told to fail instead of asking
+// Built for each clone so a refreshed GitHub App token is picked up
+func git_clone_env(target_type string, use_git_credentials bool) []string {
+	// Only the history is read, so git-lfs hooks that fire on fetch must not pull the large objects
+	env := append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GIT_LFS_SKIP_SMUDGE=1")
+	token := api_token()
+	if use_git_credentials || len(token) == 0 {
+		return env
+	}
+	// GitHub takes the token as the password for any user, Azure DevOps ignores the user and GitLab wants oauth2
+	user := "x-access-token"
+	if target_type == "azure-devops" {
+		user = ""
+	} else if target_type == "gitlab" {
+		user = "oauth2"
+	}
+	header := "Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+token))
+	// Passed as environment config rather than -c so the token isn't visible in the process list, main checks git is 2.31+
+	// The credential helpers are disabled so they can't override the token
+	return append(env, "GIT_CONFIG_COUNT=2", "GIT_CONFIG_KEY_0=http.extraHeader", "GIT_CONFIG_VALUE_0="+header, "GIT_CONFIG_KEY_1=credential.helper", "GIT_CONFIG_VALUE_1=")
+}
+
+// Hold every repo back until the listing is complete and refuse to clone if they won't fit in the budget
+// Sizes come from the API so this is an estimate, but it stops a small ramdisk filling up mid-run
+// Going over sets over_budget and cancels the harvest, so main still cleans up before it exits
+func preflight_size_check(ctx context.Context, cancel context.CancelFunc, repos chan Repo, budget uint64, size_filter uint64, over_budget *uint32) chan Repo {
+	func_logging_name := "Stage 2d - Pre-flight Size Check"
+	checked_repos := make(chan Repo, REPO_BUFFER_SIZE)
+	go func() {
+		defer close(checked_repos)
+		var held_repos []Repo
+		var total_size uint64
+		for repo := range repos {
+			held_repos = append(held_repos, repo)
+			// Repos over the size filter are never cloned
+			if size_filter == 0 || repo.Size <= size_filter {
+				total_size += repo.Size
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if total_size > budget {
+			logger.Error(fmt.Sprintf("%s: The %d repos need about %d kB, which is over the ram disk size of %d kB. Raise --ram-disk-size or lower --size-filter.", func_logging_name, len(held_repos), total_size, budget))
+			atomic.StoreUint32(over_budget, 1)
+			cancel()
+			return
+		}
+		logger.Info(func_logging_name, ": ", len(held_repos), " repos need about ", total_size, " kB of the ", budget, " kB ram disk.")
+		for _, repo := range held_repos {
+			select {
+			case <-ctx.Done():
+				return
+			case checked_repos <- repo:
+			}
+		}
+	}()
+	return checked_repos
+}
+
+// Clone flags that are always passed, or that would undo them
+var CLONE_ARGS_RESERVED = []string{"-n", "--no-checkout", "-q", "--quiet", "-v", "--verbose", "--progress", "--"}
+
+// Clone flags that make a shallow clone
+var CLONE_ARGS_SHALLOW = []string{"--depth", "--shallow-since", "--shallow-exclude"}
+
+// Depth the --deepen-threshold clones with when the --git-clone-args don't make them shallow
+// Deep enough that a busy repo shows enough authors to stay shallow
+const DEEPEN_DEFAULT_DEPTH int = 100
+
+// The git clone arguments before the url and directory, with the --git-clone-args added
+// Each extra arg has to be a flag that doesn't fight the built-in ones, a --filter replaces the default tree:0 filter
+// A path limited shortlog needs the trees, without them git would fetch them one commit at a time
+// A default_depth above 0 is added as --depth when the extra args don't already make the clone shallow
+func git_clone_args(extra_args string, path_limited bool, default_depth int) ([]string, error) {
+	args := []string{"clone", "-n", "-q"}
+	var user_args []string
+	filter := "--filter=tree:0"
+	if path_limited {
+		filter = "--filter=blob:none"
+	}
+	for _, arg := range strings.Fields(extra_args) {
+		if !strings.HasPrefix(arg, "-") {
+			return nil, fmt.Errorf("%v is not a flag, the url and directory are set by repoharvester", arg)
+		}
+		if contains_string(CLONE_ARGS_RESERVED, strings.SplitN(arg, "=", 2)[0]) {
+			return nil, fmt.Errorf("%v conflicts with the flags repoharvester always passes (-n -q)", arg)
+		}
+		if strings.HasPrefix(arg, "--filter") {
+			filter = ""
+		}
+		if contains_string(CLONE_ARGS_SHALLOW, strings.SplitN(arg, "=", 2)[0]) {
+			default_depth = 0
+		}
+		user_args = append(user_args, arg)
+	}
+	if len(filter) > 0 {
+		args = append(args, filter)
+	}
+	if default_depth > 0 {
+		args = append(args, "--depth="+strconv.Itoa(default_depth))
+	}
+	return append(args, user_args...), nil
+}
+
+// Updates a clone left by an earlier run, anything that isn't a usable repo is removed so it can be cloned fresh
+// The git dir is given explicitly so a partial clone never picks up a repo the working dir happens to be in
+func git_fetch_existing(ctx context.Context, git_path string, local_path string, git_env []string) bool {
+	git_dir := filepath.Join(local_path, ".git")
+	if _, err := os.Stat(local_path); os.IsNotExist(err) {
+		return false
+	}
+	if _, err := os.Stat(git_dir); err == nil {
+		cmd := exec.CommandContext(ctx, git_path, "--git-dir="+git_dir, "fetch", "--all", "-q")
+		cmd.Dir = local_path
+		cmd.Env = git_env
+		output, err := cmd.CombinedOutput()
+		if err == nil {
+			return true
+		}
+		logger.Infof("Stage 3 - Clone Repos: Could not update %s, cloning it again. Error: %v. Error from command: %s", local_path, err, strings.TrimSpace(string(output)))
+	}
+	if err := os.RemoveAll(local_path); err != nil {
+		logger.Error("Stage 3 - Clone Repos: Could not remove ", local_path, ". Error: ", err)
+	}
+	return false
+}
+
+// Fetches the full history of a shallow clone whose shallow history has fewer than threshold author emails
+// Runs before the shortlog so each repo is only read once, a clone that isn't shallow is left alone
+func git_deepen_sparse(ctx context.Context, git_path string, local_path string, git_env []string, threshold int) (bool, error) {
+	if _, err := os.Stat(filepath.Join(local_path, ".git", "shallow")); err != nil {
+		return false, nil
+	}
+	cmd := exec.CommandContext(ctx, git_path, "--no-pager", "shortlog", "--all", "-s", "-e")
+	cmd.Dir = local_path
+	output, err := cmd.Output()
+	if err != nil {
+		return false, err
+	}
+	authors := 0
+	for _, line := range strings.Split(string(output), "\n") {
+		if _, ok := parse_shortlog_email(line); ok {
+			authors++
+		}
+	}
+	if authors >= threshold {
+		return false, nil
+	}
+	cmd = exec.CommandContext(ctx, git_path, "fetch", "--unshallow", "-q")
+	cmd.Dir = local_path
+	cmd.Env = git_env
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return false, fmt.Errorf("%v. Error from command: %s", err, strings.TrimSpace(string(output)))
+	}
+	return true, nil
+}
+
+func git_ops_clone(ctx context.Context, repos chan Repo, git_path *string, working_dir *string, size_filter uint64, max_disk uint64, git_env func() []string, clone_args []string, cloned *ClonedRepos, reuse_clones bool, deepen_threshold int) chan Repo {
+	local_repos := make(chan Repo, REPO_BUFFER_SIZE)
+	func_logging_name := "Stage 3 - Clone Repos"
+	go func() {
+		var wg sync.WaitGroup
+		// Sizes as reported by the API, in kB, reserved before each clone and given back if it fails
+		var cloned_size uint64
+		var disk_skipped uint32
+		var size_skipped uint32
+		var reused uint32
+		var deepened uint32
+		failure_reasons := make([]uint32, len(CLONE_FAILURE_REASONS))
+		infoLogger := func() (string, bool) {
+			active := atomic.LoadUint32(&active_data[GIT_OPS_CLONE])
+			completed := atomic.LoadUint32(&completion_data[GIT_OPS_CLONE])
+			total := atomic.LoadUint32(&total_data[REMOTE_REPOS])
+
+			if active+completed+total > 0 && completed%3 == 0 {
+				var out strings.Builder
+				out.WriteString(func_logging_name)
+				out.WriteString(": Cloned ")
+				out.WriteString(strconv.FormatUint(uint64(completed), 10))
+				out.WriteString(" of a total ")
+				out.WriteString(strconv.FormatUint(uint64(total), 10))
+				out.WriteString(" repos. Active clones: ")
 				out.WriteString(strconv.FormatUint(uint64(active), 10))
 				out.WriteString(".")
 				return out.String(), true
@@ -637,15 +2559,50 @@ func git_ops_clone(ctx context.Context, repos chan Repo, git_path *string, worki
 					logger.Debug(func_logging_name, ": cleared queue of size: ", atomic.LoadUint32(&total_data[REMOTE_REPOS]), " - in-flight actions: ", atomic.LoadUint32(&active_data[GIT_OPS_CLONE]))
 					wg.Wait()
 					close(local_repos)
+					if size_skipped > 0 {
+						logger.Infof("%s: Skipped %d repos over the size filter of %d kB.", func_logging_name, size_skipped, size_filter)
+					}
+					if disk_skipped > 0 {
+						logger.Error(func_logging_name, ": Skipped ", disk_skipped, " repos after reaching the --max-disk budget")
+					}
+					if reused_count := atomic.LoadUint32(&reused); reused_count > 0 {
+						logger.Info(func_logging_name, ": Updated ", reused_count, " existing clones with git fetch")
+					}
+					if deepened_count := atomic.LoadUint32(&deepened); deepened_count > 0 {
+						logger.Info(func_logging_name, ": Deepened ", deepened_count, " shallow clones below the --deepen-threshold")
+					}
+					var reason_counts []string
+					for i, reason := range CLONE_FAILURE_REASONS {
+						if count := atomic.LoadUint32(&failure_reasons[i]); count > 0 {
+							reason_counts = append(reason_counts, reason+": "+strconv.FormatUint(uint64(count), 10))
+						}
+					}
+					if len(reason_counts) > 0 {
+						logger.Info(func_logging_name, ": Failed clones by reason - ", strings.Join(reason_counts, ", "))
+					}
 					logger.Info(func_logging_name, ": Completed. Total repos cloned: ", atomic.LoadUint32(&completion_data[GIT_OPS_CLONE]), ". Work Items Created: ", atomic.LoadUint32(&total_data[LOCAL_REPOS]), ". Error count: ", atomic.LoadUint32(&error_data[GIT_OPS_CLONE]))
 					return
 				}
 				if size_filter > 0 && repo.Size > size_filter {
 					atomic.AddUint32(&completion_data[GIT_OPS_CLONE], 1)
-					logger.Infof("%s: Skipping %s of size %d based on filter %d.", func_logging_name, repo.Name, repo.Size, size_filter)
+					size_skipped++
+					logger.Debugf("%s: Skipping %s of size %d based on filter %d.", func_logging_name, repo.Name, repo.Size, size_filter)
+					continue
+				}
+				// Once the budget is hit the rest of the queue is drained without cloning so the upstream stages can finish
+				if max_disk > 0 && (disk_skipped > 0 || atomic.LoadUint64(&cloned_size)+repo.Size > max_disk) {
+					if disk_skipped == 0 {
+						logger.Errorf("%s: Disk budget of %d kB reached after cloning %d kB. No more repos will be cloned, the partial results will still be written.", func_logging_name, max_disk, atomic.LoadUint64(&cloned_size))
+					}
+					disk_skipped++
+					atomic.AddUint32(&completion_data[GIT_OPS_CLONE], 1)
 					continue
 				}
-				err := g_semaphore.Acquire(ctx, 1)
+				atomic.AddUint64(&cloned_size, repo.Size)
+				err := g_pause.wait(ctx)
+				if err == nil {
+					err = acquire_work(ctx)
+				}
 				if err != nil {
 					wg.Wait()
 					close(local_repos)
@@ -655,47 +2612,99 @@ func git_ops_clone(ctx context.Context, repos chan Repo, git_path *string, worki
 				atomic.AddUint32(&active_data[GIT_OPS_CLONE], 1)
 				go func() {
 					defer wg.Done()
-					defer g_semaphore.Release(1)
-					cmd := exec.CommandContext(ctx, *git_path, "clone", "-n", "-q", "--filter=tree:0", repo.Clone_url)
-					cmd.Dir = *working_dir
+					defer release_work()
+					defer g_trace.add("clone", repo.Name, time.Now())
+					work_ctx, work_done := g_watchdog.watch(ctx, "clone", repo.Name)
+					defer work_done()
+					// A failed clone takes no space, so its reservation goes back to the --max-disk budget
+					free_size := func() {
+						atomic.AddUint64(&cloned_size, ^(repo.Size - 1))
+					}
+					git_env := git_env()
+					// Clone into a path derived from the name since forks share the url's basename with their source
+					repo.local_path = filepath.Join(*working_dir, repo.Name)
 					std_err := g_buff_pool.Get().(*bytes.Buffer)
 					std_err.Reset()
 					defer g_buff_pool.Put(std_err)
-					cmd.Stderr = std_err
-					err := cmd.Run()
+					var err error
+					if reuse_clones && git_fetch_existing(work_ctx, *git_path, repo.local_path, git_env) {
+						logger.Debug(func_logging_name, ": Updated the existing clone of ", repo.Name)
+						atomic.AddUint32(&reused, 1)
+					} else {
+						cmd := exec.CommandContext(work_ctx, *git_path, append(append([]string{}, clone_args...), repo.Clone_url, repo.local_path)...)
+						cmd.Dir = *working_dir
+						cmd.Env = git_env
+						cmd.Stderr = std_err
+						err = cmd.Run()
+					}
+					if err != nil && repo.wiki && ctx.Err() == nil {
+						// has_wiki is set whenever the wiki is enabled, even if it was never written to
+						logger.Debug(func_logging_name, ": No wiki to clone for ", repo.Name, ". Error from command: ", std_err.String())
+						free_size()
+						atomic.AddUint32(&completion_data[GIT_OPS_CLONE], 1)
+						atomic.AddUint32(&active_data[GIT_OPS_CLONE], ^uint32(0))
+						return
+					}
 					if err != nil {
+						free_size()
 						switch err_defined := err.(type) {
 						case *exec.ExitError:
 							// Probably a context kill
 							if !err_defined.ProcessState.Exited() && err_defined.ProcessState.ExitCode() == -1 {
 								// Really probably an ctx kill so we'll make this log level info
 								logger.Debug(func_logging_name, ": ", repo.Name, " killed by application interrupt. Error: ", err, ". Error from application: ", std_err.String())
-								repo.local_path = filepath.Join(*working_dir, repo.Name)
+								g_failures.add(func_logging_name, &repo, "", err, std_err.String())
 								atomic.AddUint32(&error_data[GIT_OPS_CLONE], 1)
 								atomic.AddUint32(&active_data[GIT_OPS_CLONE], ^uint32(0))
 								return
 							}
-							// otherwise, things are probably bad. This will be log level error
-							logger.Error(func_logging_name, ": Got an error. Repo Name: ", repo.Name, " - golang err: ", err, ". Error from command: ", std_err.String())
-							repo.local_path = filepath.Join(*working_dir, repo.Name)
+							// Otherwise git gave up, its stderr says why. Missing repos and ones that need auth are expected on recon runs so they're only info
+							reason := classify_clone_error(std_err.String())
+							for i := range CLONE_FAILURE_REASONS {
+								if CLONE_FAILURE_REASONS[i] == reason {
+									atomic.AddUint32(&failure_reasons[i], 1)
+								}
+							}
+							if clone_reason_is_expected(reason) {
+								logger.Info(func_logging_name, ": Could not clone ", repo.Name, " (", reason, ")")
+								logger.Debug(func_logging_name, ": Error from command for ", repo.Name, ": ", std_err.String())
+							} else {
+								logger.Error(func_logging_name, ": Got an error (", reason, "). Repo Name: ", repo.Name, " - golang err: ", err, ". Error from command: ", std_err.String())
+							}
+							g_failures.add_reason(func_logging_name, &repo, "", err, std_err.String(), reason)
 							atomic.AddUint32(&error_data[GIT_OPS_CLONE], 1)
 							atomic.AddUint32(&active_data[GIT_OPS_CLONE], ^uint32(0))
 							return
 						default:
 							// All other cases are log level error
 							logger.Error(func_logging_name, ": Got an error. Repo Name: ", repo.Name, " - golang err: ", err, ". Error from command: ", std_err.String())
-							repo.local_path = filepath.Join(*working_dir, repo.Name)
+							g_failures.add(func_logging_name, &repo, "", err, std_err.String())
 							atomic.AddUint32(&error_data[GIT_OPS_CLONE], 1)
 							atomic.AddUint32(&active_data[GIT_OPS_CLONE], ^uint32(0))
 							return
 						}
 					}
-					repo.local_path = filepath.Join(*working_dir, repo.Name)
+					if deepen_threshold > 0 {
+						ok, err := git_deepen_sparse(work_ctx, *git_path, repo.local_path, git_env, deepen_threshold)
+						if err != nil {
+							// The shallow history is still read
+							logger.Error(func_logging_name, ": Could not deepen ", repo.Name, ", using the shallow history. Error: ", err)
+							g_failures.add(func_logging_name, &repo, "", err, "")
+						} else if ok {
+							logger.Debug(func_logging_name, ": Deepened the shallow clone of ", repo.Name)
+							atomic.AddUint32(&deepened, 1)
+						}
+					}
+					// Waiting on the shortlog queue isn't a stall
+					work_done()
+					if cloned != nil {
+						cloned.add(repo)
+					}
 					select {
 					case <-ctx.Done():
 						return
 					case local_repos <- repo:
-						atomic.AddUint32(&total_data[LOCAL_REPOS], 2)
+						atomic.AddUint32(&total_data[LOCAL_REPOS], SHORTLOG_PASSES)
 						atomic.AddUint32(&completion_data[GIT_OPS_CLONE], 1)
 						atomic.AddUint32(&active_data[GIT_OPS_CLONE], ^uint32(0))
 						return
@@ -707,16 +2716,100 @@ func git_ops_clone(ctx context.Context, repos chan Repo, git_path *string, worki
 	return local_repos
 }
 
-func git_ops_shortlog(ctx context.Context, local_repos chan Repo, git_path *string) (chan string, chan EmailContext) {
-	emails := make(chan string, BUFFER_SIZE)
-	context_emails := make(chan EmailContext, BUFFER_SIZE)
+// File name for per repo output that won't collide across owners, forks or odd characters in names
+// The hash of the clone url keeps names unique after the characters are replaced
+func repo_file_name(repo *Repo) string {
+	name := repo.Name
+	if len(repo.Owner.Login) > 0 && !strings.HasPrefix(name, repo.Owner.Login+"/") {
+		name = repo.Owner.Login + "/" + name
+	}
+	safe_name := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '.' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+	url_hash := sha256.Sum256([]byte(repo.Clone_url))
+	return safe_name + "-" + hex.EncodeToString(url_hash[:4])
+}
+
+// Pulls the commit count out of a "  12\tName <email>" shortlog line, 0 if there isn't one
+func parse_shortlog_count(line string) uint64 {
+	tab_index := strings.Index(line, "\t")
+	if tab_index == -1 {
+		return 0
+	}
+	count, err := strconv.ParseUint(strings.TrimSpace(line[:tab_index]), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return count
+}
+
+// Pulls the email out of a "  12\tName <email>" shortlog line
+// Only lines without a bracketed email are reported as not ok, "Name <>" is an empty email that is still counted as !blank!
+func parse_shortlog_email(line string) (string, bool) {
+	line = strings.TrimRight(line, " \t\r")
+	if !strings.HasSuffix(line, ">") {
+		return "", false
+	}
+	start := strings.LastIndex(line, "<")
+	if start == -1 {
+		return "", false
+	}
+	return line[start+1 : len(line)-1], true
+}
+
+// Directories of third party code left out by --exclude-vendor
+var VENDOR_PATHS = []string{"vendor", "node_modules", "third_party"}
+
+// Pathspecs that leave out each directory wherever it is in the tree
+func exclude_pathspecs(paths []string) []string {
+	pathspecs := make([]string, 0, len(paths))
+	for _, dir := range paths {
+		// Excluding the root would leave no commits at all
+		if dir = strings.Trim(dir, "/"); len(dir) == 0 {
+			continue
+		}
+		pathspecs = append(pathspecs, ":(exclude,glob)**/"+dir+"/**")
+	}
+	return pathspecs
+}
+
+// Pulls the name out of a "  12\tName <email>" shortlog line
+func parse_shortlog_name(line string) string {
+	line = line[strings.Index(line, "\t")+1:]
+	if end := strings.LastIndex(line, "<"); end != -1 {
+		line = line[:end]
+	}
+	return strings.TrimSpace(line)
+}
+
+func git_ops_shortlog(ctx context.Context, local_repos chan Repo, git_path *string, raw_shortlog_dir string, line_counts *LineCounts, blame_max_files int, activity *ActivityHistogram, include_tags bool, cleanup_clones bool, preserve_on_error bool, commit_counts *CommitCounts, contributors *RepoContributors, exclude_paths []string, authors_only bool, directory_owners *DirectoryOwners, directory_depth int, target_type string, pr_authors *PullAuthorProfiles) (chan string, chan EmailContext) {
+	emails := make(chan string, IDENTITY_BUFFER_SIZE)
+	context_emails := make(chan EmailContext, IDENTITY_BUFFER_SIZE)
 	func_logging_name := "Stage 4 - Find Emails"
 
 	go func() {
 		var wg sync.WaitGroup
 		l_semaphore := semaphore.NewWeighted(2)
 		var sem *semaphore.Weighted
+		role_file_suffix := map[int8]string{ROLE_AUTHOR: ".author.txt", ROLE_COMMITTER: ".committer.txt", ROLE_TAGGER: ".tagger.txt"}
 		params_containers := map[int8][]string{ROLE_AUTHOR: []string{"--no-pager", "shortlog", "--all", "-n", "-e", "-s"}, ROLE_COMMITTER: []string{"--no-pager", "shortlog", "--all", "-n", "-e", "-s", "-c"}}
+		if authors_only {
+			// Every commit has an author, the committer pass would only split the same people into more roles
+			delete(params_containers, ROLE_COMMITTER)
+		}
+		if len(exclude_paths) > 0 {
+			// Only the commits that touch something outside the excluded paths are counted
+			for role := range params_containers {
+				params_containers[role] = append(append(params_containers[role], "--"), exclude_pathspecs(exclude_paths)...)
+			}
+		}
+		if include_tags {
+			// Lightweight tags have no tagger so they come out as empty lines
+			params_containers[ROLE_TAGGER] = []string{"--no-pager", "for-each-ref", "--format=%(if)%(taggeremail)%(then)%(taggername) %(taggeremail)%(end)", "refs/tags"}
+		}
 		infoLogger := func() (string, bool) {
 			active := atomic.LoadUint32(&active_data[GIT_OPS_LOG])
 			completed := atomic.LoadUint32(&completion_data[GIT_OPS_LOG])
@@ -753,9 +2846,19 @@ func git_ops_shortlog(ctx context.Context, local_repos chan Repo, git_path *stri
 					logger.Info(func_logging_name, ": Completed. Total repos processed: ", atomic.LoadUint32(&completion_data[GIT_OPS_LOG]), ". Work Items Created: ", atomic.LoadUint32(&total_data[GIT_IDENTITIES]), ". Error count: ", atomic.LoadUint32(&error_data[GIT_OPS_LOG]))
 					return
 				}
+				if err := g_pause.wait(ctx); err != nil {
+					wg.Wait()
+					close(emails)
+					close(context_emails)
+					return
+				}
+				// Tracks the jobs of this repo so its clone can be removed once they are all done
+				var repo_wg sync.WaitGroup
+				var repo_failed uint32
 				for role, params := range params_containers {
+					// The two local slots aren't capped by g_live_work so the shortlogs can always drain the clone queue
 					if !l_semaphore.TryAcquire(1) {
-						err := g_semaphore.Acquire(ctx, 1)
+						err := acquire_work(ctx)
 						if err != nil {
 							wg.Wait()
 							close(emails)
@@ -767,13 +2870,28 @@ func git_ops_shortlog(ctx context.Context, local_repos chan Repo, git_path *stri
 						sem = l_semaphore
 					}
 					wg.Add(1)
+					repo_wg.Add(1)
 					atomic.AddUint32(&active_data[GIT_OPS_LOG], 1)
 					go func(params []string, role int8, sem *semaphore.Weighted) {
 						defer wg.Done()
-						defer sem.Release(1)
+						defer repo_wg.Done()
+						if sem == g_semaphore {
+							defer release_work()
+						} else {
+							defer sem.Release(1)
+						}
+						defer g_trace.add("shortlog", repo.Name, time.Now())
+						succeeded := false
+						defer func() {
+							if !succeeded {
+								atomic.StoreUint32(&repo_failed, 1)
+							}
+						}()
 						//author_cmd := exec.CommandContext(ctx, *git_path, "--no-pager", "shortlog", "--all", "-n", "-e", "-s")
 						//commiter_cmd := exec.CommandContext(ctx, *git_path, "shortlog", "--all", "-n", "-e", "-s", "-c")
-						cmd := exec.CommandContext(ctx, *git_path, params...)
+						work_ctx, work_done := g_watchdog.watch(ctx, "shortlog", repo.Name)
+						defer work_done()
+						cmd := exec.CommandContext(work_ctx, *git_path, params...)
 						cmd.Dir = repo.local_path
 						std_out := g_buff_pool.Get().(*bytes.Buffer)
 						std_out.Reset()
@@ -785,6 +2903,8 @@ func git_ops_shortlog(ctx context.Context, local_repos chan Repo, git_path *stri
 						cmd.Stderr = std_err
 
 						err := cmd.Run()
+						// The identities are sent on from the output, waiting on the queues isn't a stall
+						work_done()
 						if err != nil {
 							switch err_defined := err.(type) {
 							case *exec.ExitError:
@@ -792,27 +2912,61 @@ func git_ops_shortlog(ctx context.Context, local_repos chan Repo, git_path *stri
 								if !err_defined.ProcessState.Exited() && err_defined.ProcessState.ExitCode() == -1 {
 									// Really probably an ctx kill so we'll make this log level info
 									logger.Debug(func_logging_name, ": ", repo.Name, " killed by interrupt. Error: ", err, ". Error from application: ", std_err.String())
+									g_failures.add(func_logging_name, &repo, "", err, std_err.String())
 									atomic.AddUint32(&error_data[GIT_OPS_LOG], 1)
 									atomic.AddUint32(&active_data[GIT_OPS_LOG], ^uint32(0))
 									return
 								}
 								// otherwise, things are probably bad. This will be log level error
 								logger.Error(func_logging_name, ": Got an error. Repo Name: ", repo.Name, " - golang err: ", err, ". Error from command: ", std_err.String())
+								g_failures.add(func_logging_name, &repo, "", err, std_err.String())
 								atomic.AddUint32(&error_data[GIT_OPS_LOG], 1)
 								atomic.AddUint32(&active_data[GIT_OPS_LOG], ^uint32(0))
 								return
 							default:
 								// All other cases are log level error
 								logger.Error(func_logging_name, ": Got an error. Repo Name: ", repo.Name, " - golang err: ", err, ". Error from command: ", std_err.String())
+								g_failures.add(func_logging_name, &repo, "", err, std_err.String())
 								atomic.AddUint32(&error_data[GIT_OPS_LOG], 1)
 								atomic.AddUint32(&active_data[GIT_OPS_LOG], ^uint32(0))
 								return
 							}
 						}
+						if len(raw_shortlog_dir) > 0 {
+							raw_file := filepath.Join(raw_shortlog_dir, repo_file_name(&repo)+role_file_suffix[role])
+							if err := ioutil.WriteFile(raw_file, std_out.Bytes(), 0600); err != nil {
+								logger.Error(func_logging_name, ": Could not write the raw shortlog for ", repo.Name, ". Error: ", err)
+							}
+						}
 						scanner := bufio.NewScanner(std_out)
+						malformed := 0
+						defer func() {
+							if malformed > 0 {
+								logger.Info(func_logging_name, ": Skipped ", malformed, " malformed shortlog lines in ", repo.Name)
+							}
+						}()
 						for scanner.Scan() {
 							full_author := scanner.Text()
-							email := full_author[strings.LastIndex(full_author, "<")+1 : len(full_author)-1]
+							if len(strings.TrimSpace(full_author)) == 0 {
+								continue
+							}
+							email, ok := parse_shortlog_email(full_author)
+							if !ok {
+								logger.Debug(func_logging_name, ": Malformed shortlog line in ", repo.Name, ": ", full_author)
+								malformed++
+								continue
+							}
+							// The committer shortlog counts the same commits again
+							if commit_counts != nil && role == ROLE_AUTHOR {
+								commit_counts.add(email, parse_shortlog_count(full_author))
+							}
+							if contributors != nil && role != ROLE_TAGGER {
+								var commits uint64
+								if role == ROLE_AUTHOR {
+									commits = parse_shortlog_count(full_author)
+								}
+								contributors.add(email, &repo, parse_shortlog_name(full_author), commits)
+							}
 							select {
 							case <-ctx.Done():
 								return
@@ -828,182 +2982,2636 @@ func git_ops_shortlog(ctx context.Context, local_repos chan Repo, git_path *stri
 							atomic.AddUint32(&total_data[GIT_IDENTITIES], 1)
 						}
 						if err = scanner.Err(); err != nil {
+							g_failures.add(func_logging_name, &repo, "", err, "")
 							atomic.AddUint32(&error_data[GIT_OPS_LOG], 1)
 							atomic.AddUint32(&active_data[GIT_OPS_LOG], ^uint32(0))
 							logger.Error(func_logging_name, ": Error scanning text, error: ", err)
 							return
 						}
+						succeeded = true
 						atomic.AddUint32(&completion_data[GIT_OPS_LOG], 1)
 						atomic.AddUint32(&active_data[GIT_OPS_LOG], ^uint32(0))
 					}(params, role, sem)
 				}
+				if line_counts != nil {
+					// Blame is far heavier than shortlog so it only ever runs on the shared pool
+					err := acquire_work(ctx)
+					if err != nil {
+						wg.Wait()
+						close(emails)
+						close(context_emails)
+						return
+					}
+					wg.Add(1)
+					repo_wg.Add(1)
+					go func(repo *Repo) {
+						defer wg.Done()
+						defer repo_wg.Done()
+						defer release_work()
+						defer g_trace.add("blame", repo.Name, time.Now())
+						work_ctx, work_done := g_watchdog.watch(ctx, "blame", repo.Name)
+						defer work_done()
+						lines, err := git_blame_lines(work_ctx, *git_path, repo.local_path, blame_max_files)
+						if err != nil {
+							logger.Error("Stage 4b - Blame: Got an error. Repo Name: ", repo.Name, " - golang err: ", err)
+							g_failures.add("Stage 4b - Blame", repo, "", err, "")
+							atomic.StoreUint32(&repo_failed, 1)
+							return
+						}
+						for email, count := range lines {
+							line_counts.add(email, repo, count)
+						}
+					}(&repo)
+				}
+				if directory_owners != nil {
+					// One shortlog per directory, run one after the other on a single worker like blame
+					err := acquire_work(ctx)
+					if err != nil {
+						wg.Wait()
+						close(emails)
+						close(context_emails)
+						return
+					}
+					wg.Add(1)
+					repo_wg.Add(1)
+					go func(repo *Repo) {
+						defer wg.Done()
+						defer repo_wg.Done()
+						defer release_work()
+						defer g_trace.add("directories", repo.Name, time.Now())
+						work_ctx, work_done := g_watchdog.watch(ctx, "directory shortlogs", repo.Name)
+						defer work_done()
+						authors, err := git_directory_authors(work_ctx, *git_path, repo.local_path, directory_depth, exclude_paths)
+						if err != nil {
+							logger.Error("Stage 4d - Directories: Got an error. Repo Name: ", repo.Name, " - golang err: ", err)
+							g_failures.add("Stage 4d - Directories", repo, "", err, "")
+							atomic.StoreUint32(&repo_failed, 1)
+							return
+						}
+						for email, directories := range authors {
+							for directory, commits := range directories {
+								directory_owners.add(email, repo, directory, commits)
+							}
+						}
+					}(&repo)
+				}
+				if activity != nil {
+					err := acquire_work(ctx)
+					if err != nil {
+						wg.Wait()
+						close(emails)
+						close(context_emails)
+						return
+					}
+					wg.Add(1)
+					repo_wg.Add(1)
+					go func(repo *Repo) {
+						defer wg.Done()
+						defer repo_wg.Done()
+						defer release_work()
+						defer g_trace.add("activity", repo.Name, time.Now())
+						work_ctx, work_done := g_watchdog.watch(ctx, "activity log", repo.Name)
+						defer work_done()
+						if err := git_log_activity(work_ctx, *git_path, repo.local_path, activity); err != nil {
+							logger.Error("Stage 4c - Activity: Got an error. Repo Name: ", repo.Name, " - golang err: ", err)
+							g_failures.add("Stage 4c - Activity", repo, "", err, "")
+							atomic.StoreUint32(&repo_failed, 1)
+						}
+					}(&repo)
+				}
+				if pr_authors != nil {
+					// Only the API is involved, so the clone doesn't wait on it
+					err := acquire_work(ctx)
+					if err != nil {
+						wg.Wait()
+						close(emails)
+						close(context_emails)
+						return
+					}
+					wg.Add(1)
+					go func(repo *Repo) {
+						defer wg.Done()
+						defer release_work()
+						if err := pull_request_authors(ctx, repo, target_type, pr_authors, contributors, emails, context_emails); err != nil {
+							logger.Error("Stage 4e - PR Authors: Got an error. Repo Name: ", repo.Name, " - golang err: ", err)
+							g_failures.add("Stage 4e - PR Authors", repo, repo.Url, err, "")
+						}
+					}(&repo)
+				}
+				if cleanup_clones {
+					wg.Add(1)
+					go func(repo *Repo) {
+						defer wg.Done()
+						repo_wg.Wait()
+						if preserve_on_error && atomic.LoadUint32(&repo_failed) == 1 {
+							logger.Info(func_logging_name, ": Keeping the clone of ", repo.Name, " in ", repo.local_path, " since it had errors")
+							return
+						}
+						if err := os.RemoveAll(repo.local_path); err != nil {
+							logger.Error(func_logging_name, ": Could not remove the clone of ", repo.Name, ". Error: ", err)
+						}
+					}(&repo)
+				}
 			}
 		}
 	}()
 	return emails, context_emails
 }
 
-func emails_dedup(emails chan string) (map[string]uint, chan struct{}) {
-	emails_deduped := make(map[string]uint, 50)
-	done := make(chan struct{})
-	go func(emails_deduped map[string]uint) {
-		var emails_processed_count uint = 0
-		for email := range emails {
-			//fmt.Println("Processing email: ", email)
-			if _, ok := emails_deduped[email]; !ok {
-				emails_deduped[email] = 0
+// Counts the lines of HEAD each author email owns according to git blame
+// Only the first max_files tracked files are blamed since each one walks the file's history
+func git_blame_lines(ctx context.Context, git_path string, local_path string, max_files int) (map[string]uint64, error) {
+	ls_cmd := exec.CommandContext(ctx, git_path, "--no-pager", "ls-tree", "-r", "-z", "--name-only", "HEAD")
+	ls_cmd.Dir = local_path
+	files, err := ls_cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	lines := make(map[string]uint64)
+	std_out := g_buff_pool.Get().(*bytes.Buffer)
+	defer g_buff_pool.Put(std_out)
+	for index, file := range strings.Split(strings.TrimRight(string(files), "\x00"), "\x00") {
+		if index >= max_files || len(file) == 0 {
+			break
+		}
+		std_out.Reset()
+		cmd := exec.CommandContext(ctx, git_path, "--no-pager", "blame", "--line-porcelain", "HEAD", "--", file)
+		cmd.Dir = local_path
+		cmd.Stdout = std_out
+		if err := cmd.Run(); err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
 			}
-			atomic.AddUint32(&completion_data[EMAILS_DEDUP], 1)
-			emails_processed_count++
+			// Binary files and submodules can't be blamed, they just don't count
+			logger.Debug("Stage 4b - Blame: Could not blame ", file, " in ", local_path, ". Error: ", err)
+			continue
 		}
-		close(done)
-		logger.Info("Stage 5a - Dedup Emails: Completed. Emails processed: ", emails_processed_count, ". Final email count: ", len(emails_deduped))
-	}(emails_deduped)
-	return emails_deduped, done
+		scanner := bufio.NewScanner(std_out)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if strings.HasPrefix(line, "author-mail ") {
+				lines[strings.TrimSuffix(strings.TrimPrefix(line[len("author-mail "):], "<"), ">")]++
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return lines, nil
 }
 
-func emails_by_repo(contexts chan EmailContext) (map[EmailGroupByRepoKey]int8, chan struct{}) {
-	emails_grouped := make(map[EmailGroupByRepoKey]int8, 50)
-	done := make(chan struct{})
-	go func(emails_grouped map[EmailGroupByRepoKey]int8) {
-		var emails_processed_count uint = 0
-		for context := range contexts {
-			//fmt.Printf("Processing email: %s for %s\n", context.EmailAddress, context.Repo.Name)
-			emails_grouped[EmailGroupByRepoKey{Email: context.EmailAddress, Repo: context.Repo}] |= context.Role
-			atomic.AddUint32(&completion_data[EMAILS_GROUPED], 1)
-			emails_processed_count++
+// Authored commits per email in each directory at the depth, a depth of 1 is the top level directories
+// The directories come from HEAD, the shortlog of each covers every branch like the main shortlog
+func git_directory_authors(ctx context.Context, git_path string, local_path string, depth int, exclude_paths []string) (map[string]map[string]uint64, error) {
+	ls_cmd := exec.CommandContext(ctx, git_path, "--no-pager", "ls-tree", "-r", "-d", "-z", "--name-only", "HEAD")
+	ls_cmd.Dir = local_path
+	directories, err := ls_cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	authors := make(map[string]map[string]uint64)
+	std_out := g_buff_pool.Get().(*bytes.Buffer)
+	defer g_buff_pool.Put(std_out)
+	for _, directory := range strings.Split(strings.TrimRight(string(directories), "\x00"), "\x00") {
+		if len(directory) == 0 || strings.Count(directory, "/") != depth-1 {
+			continue
 		}
-		close(done)
-		logger.Info("Stage 5b - Emails per Repo: Completed. Emails processed: ", emails_processed_count, ". Final contextual info count: ", len(emails_grouped))
-	}(emails_grouped)
-	return emails_grouped, done
+		std_out.Reset()
+		params := append([]string{"--no-pager", "shortlog", "--all", "-n", "-e", "-s", "--", directory}, exclude_pathspecs(exclude_paths)...)
+		cmd := exec.CommandContext(ctx, git_path, params...)
+		cmd.Dir = local_path
+		cmd.Stdout = std_out
+		if err := cmd.Run(); err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(std_out)
+		for scanner.Scan() {
+			line := scanner.Text()
+			email, ok := parse_shortlog_email(line)
+			if !ok {
+				continue
+			}
+			if _, ok := authors[email]; !ok {
+				authors[email] = make(map[string]uint64)
+			}
+			authors[email][directory] += parse_shortlog_count(line)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return authors, nil
 }
 
-func create_output_file(output_file string, emails map[string]uint) error {
-
-	output_data := g_buff_pool.Get().(*bytes.Buffer)
-	output_data.Reset()
-	defer g_buff_pool.Put(output_data)
-	for key := range emails {
-		output_data.WriteString(key)
-		output_data.WriteString(LINE_SEP)
+// Adds a commit per author email and date from the full history to the histogram
+func git_log_activity(ctx context.Context, git_path string, local_path string, activity *ActivityHistogram) error {
+	cmd := exec.CommandContext(ctx, git_path, "--no-pager", "log", "--all", "--format=%ae %aI")
+	cmd.Dir = local_path
+	std_out := g_buff_pool.Get().(*bytes.Buffer)
+	std_out.Reset()
+	defer g_buff_pool.Put(std_out)
+	cmd.Stdout = std_out
+	if err := cmd.Run(); err != nil {
+		return err
 	}
-	// Try to write three times before giving up
-	var write_counter int8 = 1
-	for {
-		// Write it as one block
-		err := ioutil.WriteFile(output_file, output_data.Bytes(), 0600)
+	scanner := bufio.NewScanner(std_out)
+	for scanner.Scan() {
+		line := scanner.Text()
+		space_index := strings.LastIndex(line, " ")
+		if space_index == -1 {
+			continue
+		}
+		when, err := time.Parse(time.RFC3339, line[space_index+1:])
 		if err != nil {
-			logger.Debug("Create Deduped File: Error writing file, attempt: ", write_counter, ". Error: ", err)
-			if write_counter > 3 {
-				return err
-			}
-			write_counter++
-			// Short sleep before retrying
-			time.Sleep(time.Millisecond * 100)
+			logger.Debug("Stage 4c - Activity: Could not parse the date in ", line, ". Error: ", err)
 			continue
 		}
-		break
+		activity.add(line[:space_index], when)
 	}
-
-	return nil
+	return scanner.Err()
 }
 
-func create_output_json(output_json string, emails_grouped map[EmailGroupByRepoKey]int8) error {
+type ApiCommitIdentity struct {
+	Name  string
+	Email string
+}
 
-	repos := make(map[string]FmtEmailPerRepo)
-	emails := make(map[string]map[string][]FmtRepoPerEmail)
+type ApiCommit struct {
+	Commit struct {
+		Author    ApiCommitIdentity
+		Committer ApiCommitIdentity
+	}
+}
 
-	role_reference := map[int8]string{ROLE_AUTHOR: ROLE_NAME_AUTHOR, ROLE_COMMITTER: ROLE_NAME_COMMITTER, ROLE_MASK_BOTH: ROLE_NAME_BOTH}
+// Stands in for the clone and shortlog stages with --no-clone
+// Pages through each repo's commits API and emits each email once per role per repo, like shortlog does
+func api_commit_emails(ctx context.Context, repos chan Repo, target_type string, commit_counts *CommitCounts, contributors *RepoContributors, authors_only bool, pr_authors *PullAuthorProfiles) (chan string, chan EmailContext) {
+	emails := make(chan string, IDENTITY_BUFFER_SIZE)
+	context_emails := make(chan EmailContext, IDENTITY_BUFFER_SIZE)
+	func_logging_name := "Stage 4 - Find Emails"
 
-	var domain string
-	for group_by_key, role_id := range emails_grouped {
-		if group_by_key.Email == "" {
-			group_by_key.Email = "!blank!"
-			domain = "!none!"
-		} else {
-			at_index := strings.LastIndex(group_by_key.Email, "@")
-			if at_index > 0 {
-				domain = string(group_by_key.Email[at_index+1:])
-			} else {
-				domain = "!none!"
+	go func() {
+		var wg sync.WaitGroup
+		defer close(context_emails)
+		defer close(emails)
+		defer wg.Wait()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case repo, ok := <-repos:
+				if !ok {
+					wg.Wait()
+					logger.Info(func_logging_name, ": Completed. Total repos processed: ", atomic.LoadUint32(&completion_data[GIT_OPS_LOG]), ". Work Items Created: ", atomic.LoadUint32(&total_data[GIT_IDENTITIES]), ". Error count: ", atomic.LoadUint32(&error_data[GIT_OPS_LOG]))
+					return
+				}
+				atomic.AddUint32(&total_data[LOCAL_REPOS], 1)
+				if len(repo.Url) == 0 {
+					err := errors.New("the API didn't return a url for the repo")
+					logger.Error(func_logging_name, ": Skipping ", repo.Name, ". Error: ", err)
+					g_failures.add(func_logging_name, &repo, "", err, "")
+					atomic.AddUint32(&error_data[GIT_OPS_LOG], 1)
+					continue
+				}
+				if err := acquire_work(ctx); err != nil {
+					return
+				}
+				wg.Add(1)
+				atomic.AddUint32(&active_data[GIT_OPS_LOG], 1)
+				go func(repo *Repo) {
+					defer wg.Done()
+					defer release_work()
+					defer atomic.AddUint32(&active_data[GIT_OPS_LOG], ^uint32(0))
+					defer g_trace.add("commits", repo.Name, time.Now())
+					seen := make(map[EmailContext]bool)
+					err := fetch_api_pages(ctx, repo.Url+"/commits?per_page="+strconv.Itoa(PER_PAGE), target_type, nil, func(dec *json.Decoder) error {
+						var commits []ApiCommit
+						if err := dec.Decode(&commits); err != nil {
+							return err
+						}
+						for _, commit := range commits {
+							if commit_counts != nil {
+								commit_counts.add(commit.Commit.Author.Email, 1)
+							}
+							identities := map[int8]ApiCommitIdentity{ROLE_AUTHOR: commit.Commit.Author, ROLE_COMMITTER: commit.Commit.Committer}
+							if authors_only {
+								delete(identities, ROLE_COMMITTER)
+							}
+							if contributors != nil {
+								contributors.add(commit.Commit.Author.Email, repo, commit.Commit.Author.Name, 1)
+								if !authors_only {
+									contributors.add(commit.Commit.Committer.Email, repo, commit.Commit.Committer.Name, 0)
+								}
+							}
+							for role, identity := range identities {
+								email_context := EmailContext{Repo: repo, EmailAddress: identity.Email, Role: role}
+								if seen[email_context] {
+									continue
+								}
+								seen[email_context] = true
+								select {
+								case <-ctx.Done():
+									return ctx.Err()
+								case emails <- identity.Email:
+								}
+								select {
+								case <-ctx.Done():
+									return ctx.Err()
+								case context_emails <- email_context:
+								}
+								atomic.AddUint32(&total_data[GIT_IDENTITIES], 1)
+							}
+						}
+						return nil
+					})
+					if err != nil {
+						logger.Error(func_logging_name, ": Got an error. Repo Name: ", repo.Name, " - golang err: ", err)
+						g_failures.add(func_logging_name, repo, repo.Url, err, "")
+						atomic.AddUint32(&error_data[GIT_OPS_LOG], 1)
+						return
+					}
+					if pr_authors != nil {
+						if err := pull_request_authors(ctx, repo, target_type, pr_authors, contributors, emails, context_emails); err != nil {
+							logger.Error("Stage 4e - PR Authors: Got an error. Repo Name: ", repo.Name, " - golang err: ", err)
+							g_failures.add("Stage 4e - PR Authors", repo, repo.Url, err, "")
+						}
+					}
+					atomic.AddUint32(&completion_data[GIT_OPS_LOG], 1)
+				}(&repo)
 			}
 		}
+	}()
+	return emails, context_emails
+}
 
-		if _, ok := repos[group_by_key.Repo.Name]; !ok {
-			repos[group_by_key.Repo.Name] = FmtEmailPerRepo{RepoUrl: group_by_key.Repo.Clone_url, Emails: map[string]string{}}
-		}
-		if _, ok := emails[domain]; !ok {
-			emails[domain] = make(map[string][]FmtRepoPerEmail)
-		}
-		if _, ok := emails[domain][group_by_key.Email]; !ok {
-			emails[domain][group_by_key.Email] = []FmtRepoPerEmail{}
-		}
+type ApiPullAuthor struct {
+	Login string
+	Id    uint64
+	Type  string // Bot for GitHub Apps
+	Url   string
+}
 
-		emails[domain][group_by_key.Email] = append(emails[domain][group_by_key.Email], FmtRepoPerEmail{RepoName: group_by_key.Repo.Name, RepoUrl: group_by_key.Repo.Clone_url, Role: role_reference[role_id]})
+type ApiPull struct {
+	User ApiPullAuthor
+}
+
+// The public profile of a PR author
+type ApiUser struct {
+	Name  string
+	Email string
+}
 
-		repos[group_by_key.Repo.Name].Emails[group_by_key.Email] = role_reference[role_id]
+// Profiles of the PR authors already looked up, the same people tend to open PRs across many repos
+type PullAuthorProfiles struct {
+	mutex    sync.Mutex
+	profiles map[string]ApiUser
+}
 
+// Looks up the author's public email once, falling back to the noreply address GitHub gives every account so the login still counts
+func (profiles *PullAuthorProfiles) Get(ctx context.Context, author ApiPullAuthor) (ApiUser, error) {
+	profiles.mutex.Lock()
+	profile, ok := profiles.profiles[author.Login]
+	profiles.mutex.Unlock()
+	if ok {
+		return profile, nil
 	}
-	output := make(map[string]interface{})
-	output["repos"] = repos
-	output["emails"] = emails
+	if _, err := get_github_api(ctx, author.Url, &profile); err != nil {
+		if ctx.Err() != nil {
+			return profile, ctx.Err()
+		}
+		logger.Debug("Stage 4e - PR Authors: Could not look up ", author.Login, ". Error: ", err)
+	}
+	if len(profile.Email) == 0 {
+		profile.Email = strconv.FormatUint(author.Id, 10) + "+" + author.Login + "@users.noreply.github.com"
+	}
+	profiles.mutex.Lock()
+	profiles.profiles[author.Login] = profile
+	profiles.mutex.Unlock()
+	return profile, nil
+}
 
-	b, err := json.MarshalIndent(output, "", "\t")
-	if err != nil {
-		return err
+// Pages through the repo's pull requests (open and closed) and emits each author once with the PR Author role
+func pull_request_authors(ctx context.Context, repo *Repo, target_type string, profiles *PullAuthorProfiles, contributors *RepoContributors, emails chan string, context_emails chan EmailContext) error {
+	defer g_trace.add("pull requests", repo.Name, time.Now())
+	if len(repo.Url) == 0 {
+		return errors.New("the API didn't return a url for the repo")
 	}
-	var write_counter int8 = 1
-	for {
-		err = ioutil.WriteFile(output_json, b, 0600)
-		if err != nil {
-			logger.Debug("Create JSON: Error writing file, attempt: ", write_counter, ". Error: ", err)
-			if write_counter > 3 {
+	seen := make(map[string]bool)
+	return fetch_api_pages(ctx, repo.Url+"/pulls?state=all&per_page="+strconv.Itoa(PER_PAGE), target_type, nil, func(dec *json.Decoder) error {
+		var pulls []ApiPull
+		if err := dec.Decode(&pulls); err != nil {
+			return err
+		}
+		for _, pull := range pulls {
+			author := pull.User
+			// A deleted account leaves no user behind
+			if len(author.Login) == 0 || author.Type == "Bot" || seen[author.Login] {
+				continue
+			}
+			seen[author.Login] = true
+			profile, err := profiles.Get(ctx, author)
+			if err != nil {
 				return err
 			}
-			write_counter++
-			time.Sleep(time.Millisecond * 100)
-			continue
+			if contributors != nil {
+				contributors.add(profile.Email, repo, profile.Name, 0)
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case emails <- profile.Email:
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case context_emails <- EmailContext{Repo: repo, EmailAddress: profile.Email, Role: ROLE_PR_AUTHOR}:
+			}
+			atomic.AddUint32(&total_data[GIT_IDENTITIES], 1)
 		}
-		break
-	}
+		return nil
+	})
+}
 
-	return nil
+// Repos asked for in one GraphQL query, each takes up to PER_PAGE commits so a query stays far below the 500,000 node limit
+const GRAPHQL_REPO_BATCH int = 10
+
+// The history of one repo's default branch, the repos of a batch are aliased r0, r1, ...
+const GRAPHQL_HISTORY_FRAGMENT string = `%s: repository(owner: $o%d, name: $n%d) {
+    defaultBranchRef {
+      target {
+        ... on Commit {
+          history(first: %d, after: $c%d) {
+            nodes { author { name email } committer { name email } }
+            pageInfo { hasNextPage endCursor }
+          }
+        }
+      }
+    }
+  }`
+
+type GraphqlRepoHistory struct {
+	// Empty repos have no default branch
+	DefaultBranchRef *struct {
+		Target struct {
+			History struct {
+				Nodes []struct {
+					Author    ApiCommitIdentity
+					Committer ApiCommitIdentity
+				}
+				PageInfo struct {
+					HasNextPage bool
+					EndCursor   string
+				}
+			}
+		}
+	}
 }
 
-func init() {
-	if runtime.GOOS == "windows" {
-		LINE_SEP = "\r\n"
-	} else {
-		LINE_SEP = "\n"
+type GraphqlHistoryResponse struct {
+	Data   map[string]*GraphqlRepoHistory
+	Errors []struct {
+		Type    string
+		Message string
+		Path    []interface{}
 	}
 }
 
-func init() {
-	args, err := parser.Parse()
-	if err != nil {
-		if flagsErr, ok := err.(*flags.Error); ok && flagsErr.Type == flags.ErrHelp {
-			os.Exit(0)
+// Build the query for the repos still paging through their history, with the variables for each alias
+func graphql_history_query(batch []*Repo, cursors []string, done []bool) (string, map[string]interface{}) {
+	var params, fields strings.Builder
+	variables := make(map[string]interface{})
+	for i, repo := range batch {
+		if done[i] {
+			continue
+		}
+		fmt.Fprintf(&params, "$o%d: String!, $n%d: String!, $c%d: String, ", i, i, i)
+		fmt.Fprintf(&fields, "  "+GRAPHQL_HISTORY_FRAGMENT+"\n", "r"+strconv.Itoa(i), i, i, PER_PAGE, i)
+		variables["o"+strconv.Itoa(i)] = repo.Owner.Login
+		variables["n"+strconv.Itoa(i)] = repo.Name
+		if len(cursors[i]) > 0 {
+			variables["c"+strconv.Itoa(i)] = cursors[i]
 		} else {
-			parser.WriteHelp(os.Stderr)
-			os.Exit(1)
+			variables["c"+strconv.Itoa(i)] = nil
 		}
 	}
-	if len(args) > 0 {
-		fmt.Fprintf(os.Stderr, "Unexpected arguments found: %s\n", strings.Join(args, " "))
-		parser.WriteHelp(os.Stderr)
-		os.Exit(1)
-	}
-	if !opts.Resource.User && !opts.Resource.Org && !opts.Resource.Url && len(opts.Resource.Type) == 0 {
-		fmt.Fprintln(os.Stderr, "Please provide either org, user or url as the target type")
-		parser.WriteHelp(os.Stderr)
-		os.Exit(1)
-	}
-	if opts.Resource.User != opts.Resource.Org != opts.Resource.Url != (len(opts.Resource.Type) == 0) {
-		fmt.Fprintln(os.Stderr, "Please use only one setting: --user, --org, --url or --type <user|org|url>")
-		parser.WriteHelp(os.Stderr)
+	return "query(" + strings.TrimSuffix(params.String(), ", ") + ") {\n" + fields.String() + "}", variables
+}
+
+// Like api_commit_emails but pages through the history of GRAPHQL_REPO_BATCH repos per request
+func graphql_commit_emails(ctx context.Context, repos chan Repo, commit_counts *CommitCounts, contributors *RepoContributors, authors_only bool, pr_authors *PullAuthorProfiles) (chan string, chan EmailContext) {
+	emails := make(chan string, IDENTITY_BUFFER_SIZE)
+	context_emails := make(chan EmailContext, IDENTITY_BUFFER_SIZE)
+	func_logging_name := "Stage 4 - Find Emails"
+
+	run_batch := func(batch []*Repo) {
+		start := time.Now()
+		cursors := make([]string, len(batch))
+		done := make([]bool, len(batch))
+		seen := make(map[EmailContext]bool)
+		remaining := len(batch)
+		fail := func(i int, err error) {
+			logger.Error(func_logging_name, ": Got an error. Repo Name: ", batch[i].Name, " - golang err: ", err)
+			g_failures.add(func_logging_name, batch[i], batch[i].Url, err, "")
+			atomic.AddUint32(&error_data[GIT_OPS_LOG], 1)
+			g_trace.add("commits", batch[i].Name, start)
+			done[i] = true
+			remaining--
+		}
+		for remaining > 0 {
+			query, variables := graphql_history_query(batch, cursors, done)
+			var result GraphqlHistoryResponse
+			err := post_graphql(ctx, query, variables, &result)
+			if err == nil && result.Data == nil && len(result.Errors) > 0 {
+				err = errors.New(result.Errors[0].Message)
+			}
+			if err != nil {
+				for i := range batch {
+					if !done[i] {
+						fail(i, err)
+					}
+				}
+				return
+			}
+			for i, repo := range batch {
+				if done[i] {
+					continue
+				}
+				alias := "r" + strconv.Itoa(i)
+				history, ok := result.Data[alias]
+				if !ok || history == nil {
+					err := errors.New("the GraphQL API didn't return the repo")
+					for _, graphql_err := range result.Errors {
+						if len(graphql_err.Path) > 0 && graphql_err.Path[0] == alias {
+							err = errors.New(graphql_err.Message)
+						}
+					}
+					fail(i, err)
+					continue
+				}
+				if history.DefaultBranchRef == nil {
+					cursors[i] = ""
+				} else {
+					commits := history.DefaultBranchRef.Target.History
+					for _, commit := range commits.Nodes {
+						if commit_counts != nil {
+							commit_counts.add(commit.Author.Email, 1)
+						}
+						identities := map[int8]ApiCommitIdentity{ROLE_AUTHOR: commit.Author, ROLE_COMMITTER: commit.Committer}
+						if authors_only {
+							delete(identities, ROLE_COMMITTER)
+						}
+						if contributors != nil {
+							contributors.add(commit.Author.Email, repo, commit.Author.Name, 1)
+							if !authors_only {
+								contributors.add(commit.Committer.Email, repo, commit.Committer.Name, 0)
+							}
+						}
+						for role, identity := range identities {
+							email_context := EmailContext{Repo: repo, EmailAddress: identity.Email, Role: role}
+							if seen[email_context] {
+								continue
+							}
+							seen[email_context] = true
+							select {
+							case <-ctx.Done():
+								return
+							case emails <- identity.Email:
+							}
+							select {
+							case <-ctx.Done():
+								return
+							case context_emails <- email_context:
+							}
+							atomic.AddUint32(&total_data[GIT_IDENTITIES], 1)
+						}
+					}
+					if commits.PageInfo.HasNextPage {
+						cursors[i] = commits.PageInfo.EndCursor
+						continue
+					}
+				}
+				atomic.AddUint32(&completion_data[GIT_OPS_LOG], 1)
+				g_trace.add("commits", repo.Name, start)
+				done[i] = true
+				remaining--
+			}
+		}
+		if pr_authors == nil {
+			return
+		}
+		// The PRs come from the REST API one repo at a time
+		for _, repo := range batch {
+			if err := pull_request_authors(ctx, repo, "", pr_authors, contributors, emails, context_emails); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				logger.Error("Stage 4e - PR Authors: Got an error. Repo Name: ", repo.Name, " - golang err: ", err)
+				g_failures.add("Stage 4e - PR Authors", repo, repo.Url, err, "")
+			}
+		}
+	}
+
+	go func() {
+		var wg sync.WaitGroup
+		defer close(context_emails)
+		defer close(emails)
+		defer wg.Wait()
+		var batch []*Repo
+		dispatch := func() bool {
+			if err := acquire_work(ctx); err != nil {
+				return false
+			}
+			wg.Add(1)
+			atomic.AddUint32(&active_data[GIT_OPS_LOG], 1)
+			go func(batch []*Repo) {
+				defer wg.Done()
+				defer release_work()
+				defer atomic.AddUint32(&active_data[GIT_OPS_LOG], ^uint32(0))
+				run_batch(batch)
+			}(batch)
+			batch = nil
+			return true
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case repo, ok := <-repos:
+				if !ok {
+					if len(batch) > 0 && !dispatch() {
+						return
+					}
+					wg.Wait()
+					logger.Info(func_logging_name, ": Completed. Total repos processed: ", atomic.LoadUint32(&completion_data[GIT_OPS_LOG]), ". Work Items Created: ", atomic.LoadUint32(&total_data[GIT_IDENTITIES]), ". Error count: ", atomic.LoadUint32(&error_data[GIT_OPS_LOG]))
+					return
+				}
+				atomic.AddUint32(&total_data[LOCAL_REPOS], 1)
+				batch = append(batch, &repo)
+				if len(batch) == GRAPHQL_REPO_BATCH && !dispatch() {
+					return
+				}
+			}
+		}
+	}()
+	return emails, context_emails
+}
+
+// On-disk store the aggregation moves to once it outgrows --spill-threshold
+// Writes are buffered and merged into the file in one transaction per batch
+type SpillStore struct {
+	db      *bolt.DB
+	path    string
+	pending map[string]uint64
+	count   int
+	merge   func(old uint64, value uint64) uint64
+}
+
+var SPILL_BUCKET = []byte("aggregation")
+
+const SPILL_BATCH_SIZE int = 10000
+
+func open_spill_store(name string, merge func(uint64, uint64) uint64) (*SpillStore, error) {
+	path := filepath.Join(SPILL_DIR, name)
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	// The file is thrown away at the end so there is no point paying for fsyncs
+	db.NoSync = true
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(SPILL_BUCKET)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SpillStore{db: db, path: path, pending: make(map[string]uint64), merge: merge}, nil
+}
+
+func (store *SpillStore) add(key string, value uint64) error {
+	if old, ok := store.pending[key]; ok {
+		value = store.merge(old, value)
+	}
+	store.pending[key] = value
+	if len(store.pending) >= SPILL_BATCH_SIZE {
+		return store.flush()
+	}
+	return nil
+}
+
+func (store *SpillStore) flush() error {
+	if len(store.pending) == 0 {
+		return nil
+	}
+	added := 0
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(SPILL_BUCKET)
+		for key, value := range store.pending {
+			if old := bucket.Get([]byte(key)); old != nil {
+				value = store.merge(binary.BigEndian.Uint64(old), value)
+			} else {
+				added++
+			}
+			// bolt holds on to the value until the transaction ends
+			value_bytes := make([]byte, 8)
+			binary.BigEndian.PutUint64(value_bytes, value)
+			if err := bucket.Put([]byte(key), value_bytes); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	store.count += added
+	store.pending = make(map[string]uint64)
+	return nil
+}
+
+// Looks up one key, the pending batch first and then the file
+func (store *SpillStore) get(key string) (uint64, bool, error) {
+	if value, ok := store.pending[key]; ok {
+		return value, true, nil
+	}
+	var value uint64
+	found := false
+	err := store.db.View(func(tx *bolt.Tx) error {
+		if value_bytes := tx.Bucket(SPILL_BUCKET).Get([]byte(key)); value_bytes != nil {
+			value = binary.BigEndian.Uint64(value_bytes)
+			found = true
+		}
+		return nil
+	})
+	return value, found, err
+}
+
+func (store *SpillStore) Len() (int, error) {
+	err := store.flush()
+	return store.count, err
+}
+
+// Visits every key in byte order
+func (store *SpillStore) ForEach(visit func(key string, value uint64)) error {
+	if err := store.flush(); err != nil {
+		return err
+	}
+	return store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(SPILL_BUCKET).ForEach(func(key []byte, value []byte) error {
+			visit(string(key), binary.BigEndian.Uint64(value))
+			return nil
+		})
+	})
+}
+
+func (store *SpillStore) Close() error {
+	err := store.db.Close()
+	os.Remove(store.path)
+	return err
+}
+
+// Deduplicated emails from the aggregation stage
+// Reads are safe while the aggregation is running and after its done channel closes
+type EmailSet struct {
+	mutex  sync.Mutex
+	emails map[string]uint
+	spill  *SpillStore
+}
+
+func (set *EmailSet) add(email string) {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+	if set.spill != nil {
+		if err := set.spill.add(email, 0); err != nil {
+			logger.Error("Stage 5a - Dedup Emails: Could not write to the spill file. Error: ", err)
+		}
+		return
+	}
+	if _, ok := set.emails[email]; !ok {
+		set.emails[email] = 0
+	}
+	if SPILL_THRESHOLD > 0 && len(set.emails) >= SPILL_THRESHOLD {
+		spill, err := open_spill_store(".repoharvester-emails.db", func(old uint64, value uint64) uint64 { return old + value })
+		if err != nil {
+			logger.Error("Stage 5a - Dedup Emails: Could not open the spill file, staying in memory. Error: ", err)
+			return
+		}
+		for email, count := range set.emails {
+			spill.add(email, uint64(count))
+		}
+		if err = spill.flush(); err != nil {
+			logger.Error("Stage 5a - Dedup Emails: Could not spill to disk, staying in memory. Error: ", err)
+			spill.Close()
+			return
+		}
+		logger.Info("Stage 5a - Dedup Emails: Spilled ", len(set.emails), " emails to ", spill.path)
+		set.spill = spill
+		set.emails = nil
+	}
+}
+
+func (set *EmailSet) Len() int {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+	if set.spill != nil {
+		count, err := set.spill.Len()
+		if err != nil {
+			logger.Error("Stage 5a - Dedup Emails: Could not read the spill file. Error: ", err)
+		}
+		return count
+	}
+	return len(set.emails)
+}
+
+func (set *EmailSet) Contains(email string) bool {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+	if set.spill != nil {
+		_, found, err := set.spill.get(email)
+		if err != nil {
+			logger.Error("Stage 5a - Dedup Emails: Could not read the spill file. Error: ", err)
+		}
+		return found
+	}
+	_, found := set.emails[email]
+	return found
+}
+
+// Visits every email in sorted order from whichever store is in use
+func (set *EmailSet) ForEach(visit func(email string)) {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+	if set.spill != nil {
+		err := set.spill.ForEach(func(email string, _ uint64) {
+			visit(email)
+		})
+		if err != nil {
+			logger.Error("Stage 5a - Dedup Emails: Could not read the spill file. Error: ", err)
+		}
+		return
+	}
+	emails := make([]string, 0, len(set.emails))
+	for email := range set.emails {
+		emails = append(emails, email)
+	}
+	sort.Strings(emails)
+	for _, email := range emails {
+		visit(email)
+	}
+}
+
+// Sorted copy of the emails
+func (set *EmailSet) Emails() []string {
+	emails := []string{}
+	set.ForEach(func(email string) {
+		emails = append(emails, email)
+	})
+	return emails
+}
+
+// Removes the spill file if there is one
+func (set *EmailSet) Close() {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+	if set.spill != nil {
+		set.spill.Close()
+	}
+}
+
+// Emails grouped by repo along with the role mask, from the aggregation stage
+// Reads are safe while the aggregation is running and after its done channel closes
+type EmailGroups struct {
+	mutex   sync.Mutex
+	grouped map[EmailGroupByRepoKey]int8
+	spill   *SpillStore
+	// Repos are stored by index in the spill file since the pointers can't be
+	repo_ids map[*Repo]uint32
+	repos    []*Repo
+}
+
+// email, a NUL and the big endian repo index
+func (groups *EmailGroups) spill_key(key EmailGroupByRepoKey) string {
+	repo_id, ok := groups.repo_ids[key.Repo]
+	if !ok {
+		repo_id = uint32(len(groups.repos))
+		groups.repo_ids[key.Repo] = repo_id
+		groups.repos = append(groups.repos, key.Repo)
+	}
+	repo_bytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(repo_bytes, repo_id)
+	return key.Email + "\x00" + string(repo_bytes)
+}
+
+func (groups *EmailGroups) add(key EmailGroupByRepoKey, role int8) {
+	groups.mutex.Lock()
+	defer groups.mutex.Unlock()
+	if groups.spill != nil {
+		if err := groups.spill.add(groups.spill_key(key), uint64(role)); err != nil {
+			logger.Error("Stage 5b - Emails per Repo: Could not write to the spill file. Error: ", err)
+		}
+		return
+	}
+	groups.grouped[key] |= role
+	if SPILL_THRESHOLD > 0 && len(groups.grouped) >= SPILL_THRESHOLD {
+		spill, err := open_spill_store(".repoharvester-groups.db", func(old uint64, value uint64) uint64 { return old | value })
+		if err != nil {
+			logger.Error("Stage 5b - Emails per Repo: Could not open the spill file, staying in memory. Error: ", err)
+			return
+		}
+		groups.repo_ids = make(map[*Repo]uint32)
+		for key, role := range groups.grouped {
+			spill.add(groups.spill_key(key), uint64(role))
+		}
+		if err = spill.flush(); err != nil {
+			logger.Error("Stage 5b - Emails per Repo: Could not spill to disk, staying in memory. Error: ", err)
+			spill.Close()
+			return
+		}
+		logger.Info("Stage 5b - Emails per Repo: Spilled ", len(groups.grouped), " entries to ", spill.path)
+		groups.spill = spill
+		groups.grouped = nil
+	}
+}
+
+func (groups *EmailGroups) Len() int {
+	groups.mutex.Lock()
+	defer groups.mutex.Unlock()
+	if groups.spill != nil {
+		count, err := groups.spill.Len()
+		if err != nil {
+			logger.Error("Stage 5b - Emails per Repo: Could not read the spill file. Error: ", err)
+		}
+		return count
+	}
+	return len(groups.grouped)
+}
+
+// Visits every email+repo and its role mask from whichever store is in use
+// The groups can't be used from inside visit
+func (groups *EmailGroups) ForEach(visit func(key EmailGroupByRepoKey, role int8)) {
+	groups.mutex.Lock()
+	defer groups.mutex.Unlock()
+	if groups.spill != nil {
+		err := groups.spill.ForEach(func(spill_key string, role uint64) {
+			split := len(spill_key) - 5
+			repo_id := binary.BigEndian.Uint32([]byte(spill_key[split+1:]))
+			visit(EmailGroupByRepoKey{Email: spill_key[:split], Repo: groups.repos[repo_id]}, int8(role))
+		})
+		if err != nil {
+			logger.Error("Stage 5b - Emails per Repo: Could not read the spill file. Error: ", err)
+		}
+		return
+	}
+	for key, role := range groups.grouped {
+		visit(key, role)
+	}
+}
+
+// Copy of the email+repo -> role mask map
+func (groups *EmailGroups) Roles() map[EmailGroupByRepoKey]int8 {
+	roles := make(map[EmailGroupByRepoKey]int8)
+	groups.ForEach(func(key EmailGroupByRepoKey, role int8) {
+		roles[key] = role
+	})
+	return roles
+}
+
+// Domain -> sorted unique emails
+func (groups *EmailGroups) EmailsByDomain() map[string][]string {
+	seen := make(map[string]bool)
+	domains := make(map[string][]string)
+	groups.ForEach(func(key EmailGroupByRepoKey, _ int8) {
+		if seen[key.Email] {
+			return
+		}
+		seen[key.Email] = true
+		domain := email_domain(key.Email)
+		domains[domain] = append(domains[domain], key.Email)
+	})
+	for _, emails := range domains {
+		sort.Strings(emails)
+	}
+	return domains
+}
+
+// Repos an email was found in along with the role mask in each
+func (groups *EmailGroups) ReposForEmail(email string) map[*Repo]int8 {
+	repos := make(map[*Repo]int8)
+	groups.ForEach(func(key EmailGroupByRepoKey, role int8) {
+		if key.Email == email {
+			repos[key.Repo] = role
+		}
+	})
+	return repos
+}
+
+// Number of repos each email was found in
+func (groups *EmailGroups) RepoCounts() map[string]int {
+	counts := make(map[string]int)
+	groups.ForEach(func(key EmailGroupByRepoKey, _ int8) {
+		counts[key.Email]++
+	})
+	return counts
+}
+
+// Removes the spill file if there is one
+func (groups *EmailGroups) Close() {
+	groups.mutex.Lock()
+	defer groups.mutex.Unlock()
+	if groups.spill != nil {
+		groups.spill.Close()
+	}
+}
+
+// Commits authored per email across every repo, from the shortlog counts
+type CommitCounts struct {
+	mutex   sync.Mutex
+	commits map[string]uint64
+}
+
+func (counts *CommitCounts) add(email string, commits uint64) {
+	counts.mutex.Lock()
+	counts.commits[email] += commits
+	counts.mutex.Unlock()
+}
+
+// The n emails with the most commits, ties go by email so the order is stable
+func (counts *CommitCounts) Top(n int, domain_allowlist map[string]bool) []FmtTopContributor {
+	counts.mutex.Lock()
+	top := make([]FmtTopContributor, 0, len(counts.commits))
+	for email, commits := range counts.commits {
+		if domain_allowed(email, domain_allowlist) {
+			top = append(top, FmtTopContributor{Email: email, Domain: email_domain(email), Commits: commits})
+		}
+	}
+	counts.mutex.Unlock()
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Commits != top[j].Commits {
+			return top[i].Commits > top[j].Commits
+		}
+		return top[i].Email < top[j].Email
+	})
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+// The name and authored commits of each email per repo, for --per-repo-dir
+type RepoContributors struct {
+	mutex   sync.Mutex
+	entries map[EmailGroupByRepoKey]*FmtRepoContributor
+}
+
+type FmtRepoContributor struct {
+	Name    string
+	Commits uint64
+}
+
+// The first name seen for an email is kept, the commits add up
+func (contributors *RepoContributors) add(email string, repo *Repo, name string, commits uint64) {
+	key := EmailGroupByRepoKey{Email: email, Repo: repo}
+	contributors.mutex.Lock()
+	defer contributors.mutex.Unlock()
+	entry, ok := contributors.entries[key]
+	if !ok {
+		entry = &FmtRepoContributor{}
+		contributors.entries[key] = entry
+	}
+	if len(entry.Name) == 0 {
+		entry.Name = name
+	}
+	entry.Commits += commits
+}
+
+// The unique display names, sorted, from the emails in the allowlist that aren't bots
+// Names that only differ in case or spacing are one person, the first spelling in sort order is kept
+func (contributors *RepoContributors) Names(domain_allowlist map[string]bool) []string {
+	contributors.mutex.Lock()
+	var names []string
+	for key, entry := range contributors.entries {
+		if !domain_allowed(key.Email, domain_allowlist) || is_bot_email(key.Email) {
+			continue
+		}
+		if name := strings.Join(strings.Fields(entry.Name), " "); len(name) > 0 {
+			names = append(names, name)
+		}
+	}
+	contributors.mutex.Unlock()
+	sort.Strings(names)
+	seen := make(map[string]bool)
+	unique := names[:0]
+	for _, name := range names {
+		if lowered := strings.ToLower(name); !seen[lowered] {
+			seen[lowered] = true
+			unique = append(unique, name)
+		}
+	}
+	return unique
+}
+
+func (contributors *RepoContributors) Get(key EmailGroupByRepoKey) FmtRepoContributor {
+	contributors.mutex.Lock()
+	defer contributors.mutex.Unlock()
+	if entry, ok := contributors.entries[key]; ok {
+		return *entry
+	}
+	return FmtRepoContributor{}
+}
+
+// Lines currently owned per email per repo from the blame pass
+type LineCounts struct {
+	mutex sync.RWMutex
+	lines map[EmailGroupByRepoKey]uint64
+}
+
+func (counts *LineCounts) add(email string, repo *Repo, lines uint64) {
+	counts.mutex.Lock()
+	counts.lines[EmailGroupByRepoKey{Email: email, Repo: repo}] += lines
+	counts.mutex.Unlock()
+}
+
+func (counts *LineCounts) Get(key EmailGroupByRepoKey) uint64 {
+	counts.mutex.RLock()
+	defer counts.mutex.RUnlock()
+	return counts.lines[key]
+}
+
+// Authored commits per email per repo in each directory from the --by-directory pass
+type DirectoryOwners struct {
+	mutex  sync.RWMutex
+	owners map[EmailGroupByRepoKey]map[string]uint64
+}
+
+func (owners *DirectoryOwners) add(email string, repo *Repo, directory string, commits uint64) {
+	key := EmailGroupByRepoKey{Email: email, Repo: repo}
+	owners.mutex.Lock()
+	defer owners.mutex.Unlock()
+	if _, ok := owners.owners[key]; !ok {
+		owners.owners[key] = make(map[string]uint64)
+	}
+	owners.owners[key][directory] += commits
+}
+
+func (owners *DirectoryOwners) Get(key EmailGroupByRepoKey) map[string]uint64 {
+	owners.mutex.RLock()
+	defer owners.mutex.RUnlock()
+	return owners.owners[key]
+}
+
+// Repos that were cloned, keyed by clone url, to tell the ones without emails from the ones never checked
+type ClonedRepos struct {
+	mutex sync.Mutex
+	repos map[string]Repo
+}
+
+func (cloned *ClonedRepos) add(repo Repo) {
+	cloned.mutex.Lock()
+	cloned.repos[repo.Clone_url] = repo
+	cloned.mutex.Unlock()
+}
+
+// Commit counts per author domain by hour of day and UTC offset, both in the commit's own timezone
+type ActivityHistogram struct {
+	mutex   sync.Mutex
+	hours   map[string]*[24]uint64
+	offsets map[string]map[string]uint64
+	last    map[string]time.Time
+}
+
+func (activity *ActivityHistogram) add(email string, when time.Time) {
+	domain := email_domain(email)
+	activity.mutex.Lock()
+	defer activity.mutex.Unlock()
+	if _, ok := activity.hours[domain]; !ok {
+		activity.hours[domain] = &[24]uint64{}
+		activity.offsets[domain] = make(map[string]uint64)
+	}
+	activity.hours[domain][when.Hour()]++
+	activity.offsets[domain][when.Format("-07:00")]++
+	if when.After(activity.last[domain]) {
+		activity.last[domain] = when
+	}
+}
+
+type FmtDomainActivity struct {
+	Hours      [24]uint64
+	UtcOffsets map[string]uint64
+	// Most recent commit by any email of the domain and how many days ago it was, tells active domains from historical ones
+	LastCommit          time.Time
+	DaysSinceLastCommit int
+}
+
+// Emails found in more than threshold repos, most widespread first
+func widespread_emails(emails_grouped *EmailGroups, threshold int) []FmtWidespreadEmail {
+	widespread := []FmtWidespreadEmail{}
+	for email, count := range emails_grouped.RepoCounts() {
+		if count > threshold {
+			widespread = append(widespread, FmtWidespreadEmail{Email: email, RepoCount: count})
+		}
+	}
+	sort.Slice(widespread, func(i, j int) bool {
+		if widespread[i].RepoCount != widespread[j].RepoCount {
+			return widespread[i].RepoCount > widespread[j].RepoCount
+		}
+		return widespread[i].Email < widespread[j].Email
+	})
+	return widespread
+}
+
+// Domain part of an email, or !none! if there isn't one
+func email_domain(email string) string {
+	at_index := strings.LastIndex(email, "@")
+	if at_index > 0 {
+		return normalize_domain(email[at_index+1:])
+	}
+	return "!none!"
+}
+
+// Maps the domain through IDNA (lower casing, NFC) and punycodes any label that isn't ASCII, so münchen.de and xn--mnchen-3ya.de group together
+// Domains IDNA rejects (e.g. with underscores) are only lower cased
+func normalize_domain(domain string) string {
+	ascii, err := idna.Lookup.ToASCII(domain)
+	if err != nil {
+		return strings.ToLower(domain)
+	}
+	return ascii
+}
+
+// Checks the email's domain (or a parent domain of it) is in the allowlist
+// An empty allowlist allows everything
+func domain_allowed(email string, domain_allowlist map[string]bool) bool {
+	return domain_in_allowlist(email_domain(email), domain_allowlist)
+}
+
+func domain_in_allowlist(domain string, domain_allowlist map[string]bool) bool {
+	if len(domain_allowlist) == 0 {
+		return true
+	}
+	domain = strings.ToLower(domain)
+	for {
+		if domain_allowlist[domain] {
+			return true
+		}
+		dot_index := strings.Index(domain, ".")
+		if dot_index == -1 {
+			return false
+		}
+		domain = domain[dot_index+1:]
+	}
+}
+
+// With more than one worker each gets its own set and the others are folded into the first at the end
+// Only the first set ever spills, so workers > 1 needs the spill disabled
+func emails_dedup(emails chan string, domain_allowlist map[string]bool, workers int) (*EmailSet, chan struct{}) {
+	emails_deduped := &EmailSet{emails: make(map[string]uint, 50)}
+	done := make(chan struct{})
+	go func(emails_deduped *EmailSet) {
+		var emails_processed_count uint32 = 0
+		var emails_dropped_count uint32 = 0
+		var wg sync.WaitGroup
+		shards := []*EmailSet{emails_deduped}
+		for len(shards) < workers {
+			shards = append(shards, &EmailSet{emails: make(map[string]uint, 50)})
+		}
+		for _, shard := range shards {
+			wg.Add(1)
+			go func(shard *EmailSet) {
+				defer wg.Done()
+				for email := range emails {
+					//fmt.Println("Processing email: ", email)
+					if domain_allowed(email, domain_allowlist) {
+						shard.add(email)
+					} else {
+						atomic.AddUint32(&emails_dropped_count, 1)
+					}
+					atomic.AddUint32(&completion_data[EMAILS_DEDUP], 1)
+					atomic.AddUint32(&emails_processed_count, 1)
+				}
+			}(shard)
+		}
+		wg.Wait()
+		for _, shard := range shards[1:] {
+			shard.ForEach(emails_deduped.add)
+		}
+		close(done)
+		if len(domain_allowlist) > 0 {
+			logger.Info("Stage 5a - Dedup Emails: Dropped ", emails_dropped_count, " identities outside the domain allowlist")
+		}
+		logger.Info("Stage 5a - Dedup Emails: Completed. Emails processed: ", emails_processed_count, ". Final email count: ", emails_deduped.Len())
+	}(emails_deduped)
+	return emails_deduped, done
+}
+
+// Sharded the same way as emails_dedup, the role masks are merged when folding
+func emails_by_repo(contexts chan EmailContext, domain_allowlist map[string]bool, workers int) (*EmailGroups, chan struct{}) {
+	emails_grouped := &EmailGroups{grouped: make(map[EmailGroupByRepoKey]int8, 50)}
+	done := make(chan struct{})
+	go func(emails_grouped *EmailGroups) {
+		var emails_processed_count uint32 = 0
+		var emails_dropped_count uint32 = 0
+		var wg sync.WaitGroup
+		shards := []*EmailGroups{emails_grouped}
+		for len(shards) < workers {
+			shards = append(shards, &EmailGroups{grouped: make(map[EmailGroupByRepoKey]int8, 50)})
+		}
+		for _, shard := range shards {
+			wg.Add(1)
+			go func(shard *EmailGroups) {
+				defer wg.Done()
+				for context := range contexts {
+					//fmt.Printf("Processing email: %s for %s\n", context.EmailAddress, context.Repo.Name)
+					if domain_allowed(context.EmailAddress, domain_allowlist) {
+						shard.add(EmailGroupByRepoKey{Email: context.EmailAddress, Repo: context.Repo}, context.Role)
+					} else {
+						atomic.AddUint32(&emails_dropped_count, 1)
+					}
+					atomic.AddUint32(&completion_data[EMAILS_GROUPED], 1)
+					atomic.AddUint32(&emails_processed_count, 1)
+				}
+			}(shard)
+		}
+		wg.Wait()
+		for _, shard := range shards[1:] {
+			shard.ForEach(emails_grouped.add)
+		}
+		close(done)
+		if len(domain_allowlist) > 0 {
+			logger.Info("Stage 5b - Emails per Repo: Dropped ", emails_dropped_count, " identities outside the domain allowlist")
+		}
+		logger.Info("Stage 5b - Emails per Repo: Completed. Emails processed: ", emails_processed_count, ". Final contextual info count: ", emails_grouped.Len())
+	}(emails_grouped)
+	return emails_grouped, done
+}
+
+// POST the run summary as JSON, the caller only logs a failure
+func send_webhook(webhook_url string, summary WebhookSummary) error {
+	body, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+	// The run context may already be cancelled (e.g. --strict) so this gets its own
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook_url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := g_http_client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %v", resp.Status)
+	}
+	return nil
+}
+
+// Serve the pipeline counters in the Prometheus text format until ctx is done
+func start_metrics_server(ctx context.Context, addr string) {
+	write_metric := func(w io.Writer, name string, metric_type string, help string, label string, label_values []string, data []uint32) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metric_type)
+		for index := range data {
+			fmt.Fprintf(w, "%s{%s=\"%s\"} %d\n", name, label, label_values[index], atomic.LoadUint32(&data[index]))
+		}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		write_metric(w, "repoharvester_active", "gauge", "Work items currently in flight per stage.", "stage", STAGE_NAMES, active_data)
+		write_metric(w, "repoharvester_completed_total", "counter", "Work items completed per stage.", "stage", STAGE_NAMES, completion_data)
+		write_metric(w, "repoharvester_errors_total", "counter", "Work items that failed per stage.", "stage", STAGE_NAMES, error_data)
+		write_metric(w, "repoharvester_items", "gauge", "Total work items discovered per queue.", "queue", QUEUE_NAMES, total_data)
+	})
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			logger.Error("Metrics server stopped. Error: ", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		shutdown_ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdown_ctx)
+	}()
+	logger.Info("Serving metrics on ", addr, "/metrics")
+}
+
+// Encryption code
+// Output files are sealed with AES-256-GCM using a key derived from the passphrase with PBKDF2-HMAC-SHA256
+// Layout: magic | iterations (uint32, big endian) | salt | nonce | ciphertext
+const (
+	ENCRYPTION_MAGIC      string = "RHENC1"
+	ENCRYPTION_SALT_SIZE  int    = 16
+	ENCRYPTION_KEY_SIZE   int    = 32
+	ENCRYPTION_ITERATIONS uint32 = 600000
+	// A header asking for more than this is corrupt or hostile, not a future default
+	ENCRYPTION_MAX_ITERATIONS uint32 = 10 * ENCRYPTION_ITERATIONS
+	ENCRYPTED_EXTENSION       string = ".enc"
+)
+
+// Empty when the output should be written in plaintext
+var OUTPUT_PASSPHRASE string
+
+func new_output_cipher(passphrase string, salt []byte, iterations uint32) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(pbkdf2.Key([]byte(passphrase), salt, int(iterations), ENCRYPTION_KEY_SIZE, sha256.New))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func encrypt_data(passphrase string, plaintext []byte) ([]byte, error) {
+	header := make([]byte, len(ENCRYPTION_MAGIC)+4+ENCRYPTION_SALT_SIZE)
+	copy(header, ENCRYPTION_MAGIC)
+	binary.BigEndian.PutUint32(header[len(ENCRYPTION_MAGIC):], ENCRYPTION_ITERATIONS)
+	salt := header[len(ENCRYPTION_MAGIC)+4:]
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := new_output_cipher(passphrase, salt, ENCRYPTION_ITERATIONS)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, len(header)+len(nonce)+len(plaintext)+aead.Overhead())
+	out = append(out, header...)
+	out = append(out, nonce...)
+	// The header is authenticated so the iteration count can't be tampered with
+	return aead.Seal(out, nonce, plaintext, header), nil
+}
+
+func decrypt_data(passphrase string, data []byte) ([]byte, error) {
+	header_len := len(ENCRYPTION_MAGIC) + 4 + ENCRYPTION_SALT_SIZE
+	if len(data) < header_len || string(data[:len(ENCRYPTION_MAGIC)]) != ENCRYPTION_MAGIC {
+		return nil, errors.New("not an encrypted repoharvester file")
+	}
+	header := data[:header_len]
+	iterations := binary.BigEndian.Uint32(header[len(ENCRYPTION_MAGIC):])
+	// Checked before deriving the key, the header is only authenticated after that
+	if iterations == 0 || iterations > ENCRYPTION_MAX_ITERATIONS {
+		return nil, fmt.Errorf("invalid iteration count %d in the header", iterations)
+	}
+	aead, err := new_output_cipher(passphrase, header[len(ENCRYPTION_MAGIC)+4:], iterations)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < header_len+aead.NonceSize() {
+		return nil, errors.New("encrypted file is truncated")
+	}
+	nonce := data[header_len : header_len+aead.NonceSize()]
+	plaintext, err := aead.Open(nil, nonce, data[header_len+aead.NonceSize():], header)
+	if err != nil {
+		return nil, errors.New("could not decrypt, wrong passphrase or corrupted file")
+	}
+	return plaintext, nil
+}
+
+// Applies the compression and at rest protections to the output before it hits the disk
+func encode_output(data []byte) ([]byte, error) {
+	if OUTPUT_GZIP {
+		var compressed bytes.Buffer
+		writer := gzip.NewWriter(&compressed)
+		if _, err := writer.Write(data); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+		data = compressed.Bytes()
+	}
+	if len(OUTPUT_PASSPHRASE) == 0 {
+		return data, nil
+	}
+	return encrypt_data(OUTPUT_PASSPHRASE, data)
+}
+
+// End encryption code
+
+const GZIP_EXTENSION string = ".gz"
+
+// Set by --gzip, every output file is gzipped
+var OUTPUT_GZIP bool
+
+// Addresses used by bots and CI rather than people
+var BOT_EMAILS = []string{"noreply@github.com", "action@github.com", "bot@renovateapp.com"}
+
+// GitHub apps commit as <id>+<name>[bot]@users.noreply.github.com, other bots tend to end their name in bot
+func is_bot_email(email string) bool {
+	email = strings.ToLower(email)
+	if contains_string(BOT_EMAILS, email) {
+		return true
+	}
+	local := email
+	if at := strings.LastIndex(email, "@"); at != -1 {
+		local = email[:at]
+	}
+	return strings.HasSuffix(local, "[bot]") || strings.HasSuffix(local, "-bot") || local == "bot"
+}
+
+func create_output_file(output_file string, emails *EmailSet, exclude_bots bool) error {
+	// Encryption seals the file as one block so it still needs the whole list in memory
+	if len(OUTPUT_PASSPHRASE) > 0 {
+		output_data := g_buff_pool.Get().(*bytes.Buffer)
+		output_data.Reset()
+		defer g_buff_pool.Put(output_data)
+		emails.ForEach(func(email string) {
+			if exclude_bots && is_bot_email(email) {
+				return
+			}
+			output_data.WriteString(email)
+			output_data.WriteString(LINE_SEP)
+		})
+		return write_output_file(output_file, output_data.Bytes(), "Create Deduped File")
+	}
+	// Try to write three times before giving up
+	var write_counter int8 = 1
+	for {
+		err := stream_output_file(output_file, emails, exclude_bots)
+		if err != nil {
+			logger.Debug("Create Deduped File: Error writing file, attempt: ", write_counter, ". Error: ", err)
+			if write_counter > 3 {
+				return err
+			}
+			write_counter++
+			// Short sleep before retrying
+			time.Sleep(time.Millisecond * 100)
+			continue
+		}
+		break
+	}
+
+	return nil
+}
+
+// Writes the sorted emails straight to the file rather than building it in memory first
+func stream_output_file(output_file string, emails *EmailSet, exclude_bots bool) error {
+	return write_file_atomic(output_file, func(file io.Writer) error {
+		var compressor *gzip.Writer
+		if OUTPUT_GZIP {
+			compressor = gzip.NewWriter(file)
+			file = compressor
+		}
+		writer := bufio.NewWriter(file)
+		var write_err error
+		emails.ForEach(func(email string) {
+			if write_err != nil || (exclude_bots && is_bot_email(email)) {
+				return
+			}
+			if _, write_err = writer.WriteString(email); write_err == nil {
+				_, write_err = writer.WriteString(LINE_SEP)
+			}
+		})
+		if write_err != nil {
+			return write_err
+		}
+		if err := writer.Flush(); err != nil || compressor == nil {
+			return err
+		}
+		return compressor.Close()
+	})
+}
+
+// Writes to a temp file next to output_path and renames it over output_path once complete
+// A second interrupt or a crash mid-write leaves the old file rather than a truncated one
+func write_file_atomic(output_path string, write func(io.Writer) error) error {
+	file, err := ioutil.TempFile(filepath.Dir(output_path), "."+filepath.Base(output_path)+".tmp")
+	if err != nil {
+		return err
+	}
+	err = write(file)
+	if err == nil {
+		err = file.Sync()
+	}
+	if close_err := file.Close(); err == nil {
+		err = close_err
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), output_path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
+
+// Owner login of the repo, or !none! for sources that don't have one
+func repo_owner(repo *Repo) string {
+	if len(repo.Owner.Login) == 0 {
+		return "!none!"
+	}
+	return repo.Owner.Login
+}
+
+// Encode the data for the disk and write it as one block, retrying three times before giving up
+func write_output_file(output_path string, data []byte, func_logging_name string) error {
+	b, err := encode_output(data)
+	if err != nil {
+		return err
+	}
+	var write_counter int8 = 1
+	for {
+		err = write_file_atomic(output_path, func(file io.Writer) error {
+			_, err := file.Write(b)
+			return err
+		})
+		if err != nil {
+			logger.Debug(func_logging_name, ": Error writing file, attempt: ", write_counter, ". Error: ", err)
+			if write_counter > 3 {
+				return err
+			}
+			write_counter++
+			// Short sleep before retrying
+			time.Sleep(time.Millisecond * 100)
+			continue
+		}
+		break
+	}
+	return nil
+}
+
+func create_widespread_file(widespread_file string, widespread []FmtWidespreadEmail) error {
+	output_data := g_buff_pool.Get().(*bytes.Buffer)
+	output_data.Reset()
+	defer g_buff_pool.Put(output_data)
+	for _, entry := range widespread {
+		output_data.WriteString(entry.Email)
+		output_data.WriteString("\t")
+		output_data.WriteString(strconv.Itoa(entry.RepoCount))
+		output_data.WriteString(LINE_SEP)
+	}
+	return write_output_file(widespread_file, output_data.Bytes(), "Create Widespread File")
+}
+
+// Names for the role bitmask in the outputs, combined collapses them all to a single contributor role
+// Masks with the tagger bit are named by joining the single roles, e.g. Author+Tagger
+func role_names(combined_roles bool) map[int8]string {
+	single_roles := []int8{ROLE_AUTHOR, ROLE_COMMITTER, ROLE_TAGGER, ROLE_PR_AUTHOR}
+	single_names := map[int8]string{ROLE_AUTHOR: ROLE_NAME_AUTHOR, ROLE_COMMITTER: ROLE_NAME_COMMITTER, ROLE_TAGGER: ROLE_NAME_TAGGER, ROLE_PR_AUTHOR: ROLE_NAME_PR_AUTHOR}
+	names := make(map[int8]string)
+	for mask := int8(1); mask <= ROLE_AUTHOR|ROLE_COMMITTER|ROLE_TAGGER|ROLE_PR_AUTHOR; mask++ {
+		if combined_roles {
+			names[mask] = ROLE_NAME_CONTRIBUTOR
+			continue
+		}
+		var parts []string
+		for _, role := range single_roles {
+			if mask&role != 0 {
+				parts = append(parts, single_names[role])
+			}
+		}
+		names[mask] = strings.Join(parts, "+")
+	}
+	return names
+}
+
+// Bipartite graph of emails to repos with the roles as edges
+// DOT can be rendered with graphviz, GEXF opens in Gephi
+func create_graph_file(graph_file string, emails_grouped *EmailGroups, graph_format string, combined_roles bool) error {
+	role_reference := role_names(combined_roles)
+	roles := emails_grouped.Roles()
+	// Sort the edges so the output is stable between runs
+	keys := make([]EmailGroupByRepoKey, 0, len(roles))
+	for key := range roles {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Email != keys[j].Email {
+			return keys[i].Email < keys[j].Email
+		}
+		return keys[i].Repo.Name < keys[j].Repo.Name
+	})
+
+	output_data := g_buff_pool.Get().(*bytes.Buffer)
+	output_data.Reset()
+	defer g_buff_pool.Put(output_data)
+	seen_nodes := make(map[string]bool)
+	if graph_format == "gexf" {
+		xml_text := func(text string) string {
+			var escaped strings.Builder
+			xml.EscapeText(&escaped, []byte(text))
+			return escaped.String()
+		}
+		output_data.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + LINE_SEP)
+		output_data.WriteString(`<gexf xmlns="http://www.gexf.net/1.2draft" version="1.2">` + LINE_SEP)
+		output_data.WriteString(`<graph defaultedgetype="undirected">` + LINE_SEP)
+		output_data.WriteString(`<attributes class="node"><attribute id="0" title="type" type="string"/></attributes>` + LINE_SEP)
+		output_data.WriteString(`<nodes>` + LINE_SEP)
+		for _, key := range keys {
+			for _, node := range [][2]string{{"email:" + key.Email, "email"}, {"repo:" + key.Repo.Name, "repo"}} {
+				if seen_nodes[node[0]] {
+					continue
+				}
+				seen_nodes[node[0]] = true
+				label := strings.SplitN(node[0], ":", 2)[1]
+				output_data.WriteString(`<node id="` + xml_text(node[0]) + `" label="` + xml_text(label) + `"><attvalues><attvalue for="0" value="` + node[1] + `"/></attvalues></node>` + LINE_SEP)
+			}
+		}
+		output_data.WriteString(`</nodes>` + LINE_SEP)
+		output_data.WriteString(`<edges>` + LINE_SEP)
+		for index, key := range keys {
+			output_data.WriteString(`<edge id="` + strconv.Itoa(index) + `" source="` + xml_text("email:"+key.Email) + `" target="` + xml_text("repo:"+key.Repo.Name) + `" label="` + role_reference[roles[key]] + `"/>` + LINE_SEP)
+		}
+		output_data.WriteString(`</edges>` + LINE_SEP)
+		output_data.WriteString(`</graph>` + LINE_SEP)
+		output_data.WriteString(`</gexf>` + LINE_SEP)
+	} else {
+		dot_text := func(text string) string {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(text) + `"`
+		}
+		output_data.WriteString("graph repoharvester {" + LINE_SEP)
+		for _, key := range keys {
+			if !seen_nodes["email:"+key.Email] {
+				seen_nodes["email:"+key.Email] = true
+				output_data.WriteString("\t" + dot_text("email:"+key.Email) + " [label=" + dot_text(key.Email) + ", shape=ellipse];" + LINE_SEP)
+			}
+			if !seen_nodes["repo:"+key.Repo.Name] {
+				seen_nodes["repo:"+key.Repo.Name] = true
+				output_data.WriteString("\t" + dot_text("repo:"+key.Repo.Name) + " [label=" + dot_text(key.Repo.Name) + ", shape=box];" + LINE_SEP)
+			}
+			output_data.WriteString("\t" + dot_text("email:"+key.Email) + " -- " + dot_text("repo:"+key.Repo.Name) + " [label=" + dot_text(role_reference[roles[key]]) + "];" + LINE_SEP)
+		}
+		output_data.WriteString("}" + LINE_SEP)
+	}
+	return write_output_file(graph_file, output_data.Bytes(), "Create Graph File")
+}
+
+// Per domain commit hours, domains outside the allowlist are left out like the other outputs
+func create_activity_file(activity_file string, activity *ActivityHistogram, domain_allowlist map[string]bool) error {
+	output := make(map[string]FmtDomainActivity)
+	activity.mutex.Lock()
+	for domain, hours := range activity.hours {
+		if !domain_in_allowlist(domain, domain_allowlist) {
+			continue
+		}
+		offsets := make(map[string]uint64, len(activity.offsets[domain]))
+		for offset, count := range activity.offsets[domain] {
+			offsets[offset] = count
+		}
+		last := activity.last[domain]
+		output[domain] = FmtDomainActivity{Hours: *hours, UtcOffsets: offsets, LastCommit: last.UTC(), DaysSinceLastCommit: int(time.Since(last).Hours() / 24)}
+	}
+	activity.mutex.Unlock()
+
+	b, err := json.MarshalIndent(output, "", "\t")
+	if err != nil {
+		return err
+	}
+	return write_output_file(activity_file, b, "Create Activity File")
+}
+
+// The cloned repos that have nothing in emails_grouped, sorted by clone url
+func no_identity_repos(cloned *ClonedRepos, emails_grouped *EmailGroups) []Repo {
+	with_identities := make(map[string]bool)
+	emails_grouped.ForEach(func(key EmailGroupByRepoKey, _ int8) {
+		with_identities[key.Repo.Clone_url] = true
+	})
+	cloned.mutex.Lock()
+	defer cloned.mutex.Unlock()
+	repos := []Repo{}
+	for clone_url, repo := range cloned.repos {
+		if !with_identities[clone_url] {
+			repos = append(repos, repo)
+		}
+	}
+	sort.Slice(repos, func(i, j int) bool { return repos[i].Clone_url < repos[j].Clone_url })
+	return repos
+}
+
+func create_no_identity_file(no_identity_file string, repos []Repo) error {
+	output_data := g_buff_pool.Get().(*bytes.Buffer)
+	output_data.Reset()
+	defer g_buff_pool.Put(output_data)
+	for _, repo := range repos {
+		output_data.WriteString(repo.Name)
+		output_data.WriteString("\t")
+		output_data.WriteString(repo.Clone_url)
+		output_data.WriteString(LINE_SEP)
+	}
+	return write_output_file(no_identity_file, output_data.Bytes(), "Create No Identity File")
+}
+
+// How many of the slowest spans are listed on their own in the trace
+const TRACE_SLOWEST int = 20
+
+// A stage runs from the start of its first span to the end of its last, busy time is the sum of the spans
+type FmtTraceStage struct {
+	Stage       string
+	Start       time.Time
+	End         time.Time
+	Seconds     float64
+	BusySeconds float64
+	Operations  int
+}
+
+type FmtTrace struct {
+	Started time.Time
+	Ended   time.Time
+	Seconds float64
+	Stages  []FmtTraceStage
+	Slowest []TraceSpan
+	Spans   []TraceSpan
+}
+
+func build_trace(started time.Time, spans []TraceSpan) FmtTrace {
+	trace := FmtTrace{Started: started, Ended: time.Now(), Stages: []FmtTraceStage{}, Spans: spans}
+	trace.Seconds = trace.Ended.Sub(started).Seconds()
+	stages := make(map[string]*FmtTraceStage)
+	order := []string{}
+	for _, span := range spans {
+		stage, ok := stages[span.Stage]
+		if !ok {
+			stage = &FmtTraceStage{Stage: span.Stage, Start: span.Start, End: span.End}
+			stages[span.Stage] = stage
+			order = append(order, span.Stage)
+		}
+		if span.Start.Before(stage.Start) {
+			stage.Start = span.Start
+		}
+		if span.End.After(stage.End) {
+			stage.End = span.End
+		}
+		stage.BusySeconds += span.Seconds
+		stage.Operations++
+	}
+	for _, name := range order {
+		stage := stages[name]
+		stage.Seconds = stage.End.Sub(stage.Start).Seconds()
+		trace.Stages = append(trace.Stages, *stage)
+	}
+	sort.Slice(trace.Stages, func(i, j int) bool {
+		return trace.Stages[i].Start.Before(trace.Stages[j].Start)
+	})
+
+	// Only the per repo spans, the pages say little about which repos to look at
+	for _, span := range spans {
+		if span.Stage != "fetch" && span.Stage != "parse" {
+			trace.Slowest = append(trace.Slowest, span)
+		}
+	}
+	sort.Slice(trace.Slowest, func(i, j int) bool {
+		return trace.Slowest[i].Seconds > trace.Slowest[j].Seconds
+	})
+	if len(trace.Slowest) > TRACE_SLOWEST {
+		trace.Slowest = trace.Slowest[:TRACE_SLOWEST]
+	}
+	sort.Slice(trace.Spans, func(i, j int) bool {
+		return trace.Spans[i].Start.Before(trace.Spans[j].Start)
+	})
+	return trace
+}
+
+func create_trace_file(trace_file string, trace FmtTrace) error {
+	b, err := json.MarshalIndent(trace, "", "\t")
+	if err != nil {
+		return err
+	}
+	return write_output_file(trace_file, b, "Create Trace File")
+}
+
+// Rows in each ranked section of the report, the domains are all listed
+const REPORT_TOP int = 20
+
+type FmtRepoIdentities struct {
+	Repo   string
+	Emails int
+}
+
+// The repos with the most unique emails, ties go by name
+func repos_by_identities(emails_grouped *EmailGroups) []FmtRepoIdentities {
+	emails := make(map[string]map[string]bool)
+	emails_grouped.ForEach(func(key EmailGroupByRepoKey, _ int8) {
+		if _, ok := emails[key.Repo.Name]; !ok {
+			emails[key.Repo.Name] = make(map[string]bool)
+		}
+		emails[key.Repo.Name][key.Email] = true
+	})
+	repos := make([]FmtRepoIdentities, 0, len(emails))
+	for name, repo_emails := range emails {
+		repos = append(repos, FmtRepoIdentities{Repo: name, Emails: len(repo_emails)})
+	}
+	sort.Slice(repos, func(i, j int) bool {
+		if repos[i].Emails != repos[j].Emails {
+			return repos[i].Emails > repos[j].Emails
+		}
+		return repos[i].Repo < repos[j].Repo
+	})
+	if len(repos) > REPORT_TOP {
+		repos = repos[:REPORT_TOP]
+	}
+	return repos
+}
+
+// Plain text summary for pasting into reports, each section is a table like the ones printed at the end of a run
+func create_report_file(report_file string, target string, emails_grouped *EmailGroups, top []FmtTopContributor) error {
+	var output_data bytes.Buffer
+	w := new(tabwriter.Writer)
+	w.Init(&output_data, 0, 4, 2, ' ', 0)
+
+	fmt.Fprintln(&output_data, "Repoharvester report for", target)
+	fmt.Fprintln(&output_data, "Generated", time.Now().UTC().Format(time.RFC3339))
+
+	by_domain := emails_grouped.EmailsByDomain()
+	domains := make([]string, 0, len(by_domain))
+	for domain := range by_domain {
+		domains = append(domains, domain)
+	}
+	sort.Slice(domains, func(i, j int) bool {
+		if len(by_domain[domains[i]]) != len(by_domain[domains[j]]) {
+			return len(by_domain[domains[i]]) > len(by_domain[domains[j]])
+		}
+		return domains[i] < domains[j]
+	})
+	fmt.Fprintln(&output_data, "\nDomains (with counts)")
+	fmt.Fprintln(w, "Domain\tEmails\t")
+	for _, domain := range domains {
+		fmt.Fprintln(w, domain, "\t", len(by_domain[domain]), "\t")
+	}
+	w.Flush()
+
+	fmt.Fprintln(&output_data, "\nTop contributors")
+	write_top_table(w, top)
+
+	fmt.Fprintln(&output_data, "\nRepos with the most identities")
+	fmt.Fprintln(w, "Repo\tEmails\t")
+	for _, repo := range repos_by_identities(emails_grouped) {
+		fmt.Fprintln(w, repo.Repo, "\t", repo.Emails, "\t")
+	}
+	w.Flush()
+
+	return write_output_file(report_file, output_data.Bytes(), "Create Report File")
+}
+
+// One CSV of email, name, role and authored commits per repo, named with repo_file_name so owners and forks don't collide
+func create_per_repo_files(per_repo_dir string, extension string, emails_grouped *EmailGroups, contributors *RepoContributors, combined_roles bool) (int, error) {
+	role_reference := role_names(combined_roles)
+	rows := make(map[*Repo][][]string)
+	emails_grouped.ForEach(func(key EmailGroupByRepoKey, role_id int8) {
+		contributor := contributors.Get(key)
+		rows[key.Repo] = append(rows[key.Repo], []string{key.Email, contributor.Name, role_reference[role_id], strconv.FormatUint(contributor.Commits, 10)})
+	})
+	for repo, repo_rows := range rows {
+		sort.Slice(repo_rows, func(i, j int) bool {
+			return repo_rows[i][0] < repo_rows[j][0]
+		})
+		var output_data bytes.Buffer
+		writer := csv.NewWriter(&output_data)
+		writer.Write([]string{"email", "name", "role", "commits"})
+		writer.WriteAll(repo_rows)
+		if err := writer.Error(); err != nil {
+			return 0, err
+		}
+		if err := write_output_file(filepath.Join(per_repo_dir, repo_file_name(repo)+extension), output_data.Bytes(), "Create Per Repo Files"); err != nil {
+			return 0, err
+		}
+	}
+	return len(rows), nil
+}
+
+func create_fetch_log_file(fetch_log_file string, records []FetchRecord) error {
+	b, err := json.MarshalIndent(records, "", "\t")
+	if err != nil {
+		return err
+	}
+	return write_output_file(fetch_log_file, b, "Create Fetch Log File")
+}
+
+func create_names_file(names_file string, names []string) error {
+	output_data := g_buff_pool.Get().(*bytes.Buffer)
+	output_data.Reset()
+	defer g_buff_pool.Put(output_data)
+	for _, name := range names {
+		output_data.WriteString(name)
+		output_data.WriteString(LINE_SEP)
+	}
+	return write_output_file(names_file, output_data.Bytes(), "Create Names File")
+}
+
+func create_errors_file(errors_file string, records []FailureRecord) error {
+	b, err := json.MarshalIndent(records, "", "\t")
+	if err != nil {
+		return err
+	}
+	return write_output_file(errors_file, b, "Create Errors File")
+}
+
+// Builds the document written to the --json, also the grouped part of the --combined
+func output_json_data(emails_grouped *EmailGroups, nest_by_owner bool, widespread_threshold int, line_counts *LineCounts, combined_roles bool, domain_info map[string]FmtDomainInfo, known_domains map[string]bool, with_visibility bool, renamed_targets map[string]string, directory_owners *DirectoryOwners, target_domains map[string]bool, meta FmtMeta) map[string]interface{} {
+
+	repos := make(map[string]FmtEmailPerRepo)
+	repos_by_owner := make(map[string]map[string]FmtEmailPerRepo)
+	emails := make(map[string]map[string][]FmtRepoPerEmail)
+	email_lines := make(map[string]uint64)
+	// Whether each email is in at least one private repo
+	email_private := make(map[string]bool)
+	// Whether each email is in one of the target's domains
+	email_internal := make(map[string]bool)
+	// A spelling of each domain as it was found when that differs from the lower cased group, e.g. Corp.com for corp.com
+	domain_casing := make(map[string]string)
+
+	role_reference := role_names(combined_roles)
+
+	var domain string
+	emails_grouped.ForEach(func(group_by_key EmailGroupByRepoKey, role_id int8) {
+		var lines uint64
+		if line_counts != nil {
+			// Looked up before the blank rename since the counts are keyed on the raw email
+			lines = line_counts.Get(group_by_key)
+		}
+		var directories map[string]uint64
+		if directory_owners != nil {
+			directories = directory_owners.Get(group_by_key)
+		}
+		if group_by_key.Email == "" {
+			group_by_key.Email = "!blank!"
+		}
+		domain = email_domain(group_by_key.Email)
+		if original := group_by_key.Email[strings.LastIndex(group_by_key.Email, "@")+1:]; original != domain && domain != "!none!" {
+			// The smallest spelling keeps the sample the same between runs
+			if sample, ok := domain_casing[domain]; !ok || original < sample {
+				domain_casing[domain] = original
+			}
+		}
+		email_lines[group_by_key.Email] += lines
+		private := with_visibility && group_by_key.Repo.Private
+		email_private[group_by_key.Email] = email_private[group_by_key.Email] || private
+		// An empty list would match everything, here it means nothing is internal
+		email_internal[group_by_key.Email] = len(target_domains) > 0 && domain_in_allowlist(domain, target_domains)
+
+		// Repo names are only unique per owner, so optionally nest them to keep multiple owners apart
+		repo_name := group_by_key.Repo.Name
+		repo_entries := repos
+		var owner string
+		if nest_by_owner {
+			owner = repo_owner(group_by_key.Repo)
+			repo_name = strings.TrimPrefix(repo_name, owner+"/")
+			if _, ok := repos_by_owner[owner]; !ok {
+				repos_by_owner[owner] = make(map[string]FmtEmailPerRepo)
+			}
+			repo_entries = repos_by_owner[owner]
+		}
+
+		if _, ok := repo_entries[repo_name]; !ok {
+			repo_entries[repo_name] = FmtEmailPerRepo{RepoUrl: group_by_key.Repo.Clone_url, RepoId: group_by_key.Repo.Id, NodeId: group_by_key.Repo.Node_id, Description: group_by_key.Repo.Description, Homepage: group_by_key.Repo.Homepage, Emails: map[string]string{}}
+			if directory_owners != nil {
+				repo_entry := repo_entries[repo_name]
+				repo_entry.Directories = make(map[string]map[string]uint64)
+				repo_entries[repo_name] = repo_entry
+			}
+		}
+		for directory, commits := range directories {
+			if _, ok := repo_entries[repo_name].Directories[directory]; !ok {
+				repo_entries[repo_name].Directories[directory] = make(map[string]uint64)
+			}
+			repo_entries[repo_name].Directories[directory][group_by_key.Email] = commits
+		}
+		if _, ok := emails[domain]; !ok {
+			emails[domain] = make(map[string][]FmtRepoPerEmail)
+		}
+		if _, ok := emails[domain][group_by_key.Email]; !ok {
+			emails[domain][group_by_key.Email] = []FmtRepoPerEmail{}
+		}
+
+		emails[domain][group_by_key.Email] = append(emails[domain][group_by_key.Email], FmtRepoPerEmail{RepoName: repo_name, RepoOwner: owner, RepoUrl: group_by_key.Repo.Clone_url, Role: role_reference[role_id], Lines: lines, Private: private})
+
+		repo_entries[repo_name].Emails[group_by_key.Email] = role_reference[role_id]
+	})
+	output := make(map[string]interface{})
+	if nest_by_owner {
+		output["repos"] = repos_by_owner
+	} else {
+		output["repos"] = repos
+	}
+	output["emails"] = emails
+	output["meta"] = meta
+	output["widespread"] = widespread_emails(emails_grouped, widespread_threshold)
+	if line_counts != nil {
+		output["lines"] = email_lines
+	}
+	if with_visibility {
+		output["private"] = email_private
+	}
+	output["internal"] = email_internal
+	internal_domains := []string{}
+	for domain := range target_domains {
+		internal_domains = append(internal_domains, domain)
+	}
+	sort.Strings(internal_domains)
+	output["target_domains"] = internal_domains
+	if len(domain_casing) > 0 {
+		output["domain_casing"] = domain_casing
+	}
+	// Only there when a target was renamed, the repos are listed under the canonical name
+	if len(renamed_targets) > 0 {
+		output["renamed_targets"] = renamed_targets
+	}
+	if known_domains != nil {
+		output["new_domains"] = new_domains(emails_grouped, known_domains)
+	}
+	if domain_info != nil {
+		output["domains"] = domain_info
+		unresolved_domains := []string{}
+		for domain, info := range domain_info {
+			if !info.Resolves {
+				unresolved_domains = append(unresolved_domains, domain)
+			}
+		}
+		sort.Strings(unresolved_domains)
+		output["unresolved_domains"] = unresolved_domains
+	}
+	return output
+}
+
+func create_output_json(output_json string, output map[string]interface{}) error {
+	b, err := json.MarshalIndent(output, "", "\t")
+	if err != nil {
+		return err
+	}
+	return write_output_file(output_json, b, "Create JSON")
+}
+
+// Writes the deduped emails and the grouped JSON side by side, for scripts that want a single file
+func create_combined_file(combined_file string, emails *EmailSet, output map[string]interface{}) error {
+	b, err := json.MarshalIndent(FmtCombined{Emails: emails.Emails(), Grouped: output}, "", "\t")
+	if err != nil {
+		return err
+	}
+	return write_output_file(combined_file, b, "Create Combined File")
+}
+
+// Loads the emails and repos from a previous --json output
+// Only the emails section is read, so it works with and without --nest-by-owner
+func load_baseline(baseline_file string, passphrase string) (*Baseline, error) {
+	data, err := ioutil.ReadFile(baseline_file)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(string(data), ENCRYPTION_MAGIC) {
+		if len(passphrase) == 0 {
+			return nil, errors.New("the baseline is encrypted, provide the passphrase")
+		}
+		data, err = decrypt_data(passphrase, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// A --gzip output, the magic bytes can't start a JSON document
+	if bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		data, err = ioutil.ReadAll(reader)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var previous struct {
+		Emails map[string]map[string][]FmtRepoPerEmail `json:"emails"`
+	}
+	if err = json.Unmarshal(data, &previous); err != nil {
+		return nil, err
+	}
+	baseline := &Baseline{Emails: make(map[string]bool), Repos: make(map[string]string)}
+	for _, domain_emails := range previous.Emails {
+		for email, email_repos := range domain_emails {
+			baseline.Emails[email] = true
+			for _, repo := range email_repos {
+				repo_name := repo.RepoName
+				if len(repo.RepoOwner) > 0 {
+					repo_name = repo.RepoOwner + "/" + repo_name
+				}
+				baseline.Repos[repo.RepoUrl] = repo_name
+			}
+		}
+	}
+	return baseline, nil
+}
+
+// Compares this run's results against the baseline
+func create_baseline_diff(diff_file string, emails_grouped *EmailGroups, baseline *Baseline) error {
+	current := &Baseline{Emails: make(map[string]bool), Repos: make(map[string]string)}
+	emails_grouped.ForEach(func(group_by_key EmailGroupByRepoKey, _ int8) {
+		// Matches the key used in the JSON output
+		if group_by_key.Email == "" {
+			group_by_key.Email = "!blank!"
+		}
+		current.Emails[group_by_key.Email] = true
+		current.Repos[group_by_key.Repo.Clone_url] = group_by_key.Repo.Name
+	})
+	return write_baseline_diff(diff_file, baseline, current)
+}
+
+// Writes what was added to or removed from the baseline in current, every list is sorted
+func write_baseline_diff(diff_file string, baseline *Baseline, current *Baseline) error {
+	diff := FmtBaselineDiff{NewEmails: []string{}, RemovedEmails: []string{}, NewRepos: []FmtBaselineRepo{}, RemovedRepos: []FmtBaselineRepo{}}
+	for email := range current.Emails {
+		if !baseline.Emails[email] {
+			diff.NewEmails = append(diff.NewEmails, email)
+		}
+	}
+	for email := range baseline.Emails {
+		if !current.Emails[email] {
+			diff.RemovedEmails = append(diff.RemovedEmails, email)
+		}
+	}
+	for repo_url, repo_name := range current.Repos {
+		if _, ok := baseline.Repos[repo_url]; !ok {
+			diff.NewRepos = append(diff.NewRepos, FmtBaselineRepo{RepoName: repo_name, RepoUrl: repo_url})
+		}
+	}
+	for repo_url, repo_name := range baseline.Repos {
+		if _, ok := current.Repos[repo_url]; !ok {
+			diff.RemovedRepos = append(diff.RemovedRepos, FmtBaselineRepo{RepoName: repo_name, RepoUrl: repo_url})
+		}
+	}
+	sort.Strings(diff.NewEmails)
+	sort.Strings(diff.RemovedEmails)
+	sort.Slice(diff.NewRepos, func(i, j int) bool { return diff.NewRepos[i].RepoUrl < diff.NewRepos[j].RepoUrl })
+	sort.Slice(diff.RemovedRepos, func(i, j int) bool { return diff.RemovedRepos[i].RepoUrl < diff.RemovedRepos[j].RepoUrl })
+	logger.Info("Baseline Diff: ", len(diff.NewEmails), " new emails, ", len(diff.RemovedEmails), " removed emails, ", len(diff.NewRepos), " new repos, ", len(diff.RemovedRepos), " removed repos")
+
+	b, err := json.MarshalIndent(diff, "", "\t")
+	if err != nil {
+		return err
+	}
+	return write_output_file(diff_file, b, "Create Baseline Diff")
+}
+
+// Concurrent lookups for --validate-domains and how long each may take
+const (
+	DOMAIN_LOOKUP_WORKERS int64         = 10
+	DOMAIN_LOOKUP_TIMEOUT time.Duration = 5 * time.Second
+)
+
+// MX lookup of each domain, a domain without MX records still resolves if it has an address (the implicit MX)
+func validate_domains(ctx context.Context, domains []string) map[string]FmtDomainInfo {
+	func_logging_name := "Validate Domains"
+	var resolver net.Resolver
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	results := make(map[string]FmtDomainInfo, len(domains))
+	sem := semaphore.NewWeighted(DOMAIN_LOOKUP_WORKERS)
+	for _, domain := range domains {
+		if err := sem.Acquire(ctx, 1); err != nil {
+			break
+		}
+		wg.Add(1)
+		go func(domain string) {
+			defer wg.Done()
+			defer sem.Release(1)
+			lookup_ctx, cancel := context.WithTimeout(ctx, DOMAIN_LOOKUP_TIMEOUT)
+			defer cancel()
+			info := FmtDomainInfo{MailHosts: []string{}}
+			records, err := resolver.LookupMX(lookup_ctx, domain)
+			if err == nil && len(records) > 0 {
+				info.Resolves = true
+				for _, record := range records {
+					info.MailHosts = append(info.MailHosts, strings.TrimSuffix(record.Host, "."))
+				}
+			} else if _, err := resolver.LookupHost(lookup_ctx, domain); err == nil {
+				info.Resolves = true
+			} else {
+				logger.Debug(func_logging_name, ": ", domain, " doesn't resolve. Error: ", err)
+			}
+			mutex.Lock()
+			results[domain] = info
+			mutex.Unlock()
+		}(domain)
+	}
+	wg.Wait()
+	unresolved := 0
+	for _, info := range results {
+		if !info.Resolves {
+			unresolved++
+		}
+	}
+	logger.Info(func_logging_name, ": Checked ", len(results), " domains, ", unresolved, " don't resolve")
+	return results
+}
+
+// Reads a domain per line, blank lines and # comments are skipped
+func load_known_domains(known_domains_file string) (map[string]bool, error) {
+	data, err := ioutil.ReadFile(known_domains_file)
+	if err != nil {
+		return nil, err
+	}
+	known_domains := make(map[string]bool)
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		known_domains[normalize_domain(line)] = true
+	}
+	return known_domains, nil
+}
+
+// Domains of webmail providers and the GitHub noreply addresses, never taken for the target's own domain
+var PERSONAL_EMAIL_DOMAINS = []string{"gmail.com", "googlemail.com", "outlook.com", "hotmail.com", "live.com", "yahoo.com", "icloud.com", "me.com", "protonmail.com", "users.noreply.github.com"}
+
+// The domain with the most emails when no --target-domains are given, empty if there are none to pick from
+func infer_target_domain(emails_grouped *EmailGroups) string {
+	var target_domain string
+	var target_count int
+	for domain, emails := range emails_grouped.EmailsByDomain() {
+		if domain == "!none!" || contains_string(PERSONAL_EMAIL_DOMAINS, domain) {
+			continue
+		}
+		// Ties go to the smallest name so the pick is the same between runs
+		if len(emails) > target_count || (len(emails) == target_count && domain < target_domain) {
+			target_domain = domain
+			target_count = len(emails)
+		}
+	}
+	return target_domain
+}
+
+// Domains that aren't known (or a subdomain of a known one), most emails first
+func new_domains(emails_grouped *EmailGroups, known_domains map[string]bool) []FmtNewDomain {
+	found := []FmtNewDomain{}
+	for domain, emails := range emails_grouped.EmailsByDomain() {
+		// An empty list would allow everything, but here it means nothing is known
+		if domain == "!none!" || (len(known_domains) > 0 && domain_in_allowlist(domain, known_domains)) {
+			continue
+		}
+		found = append(found, FmtNewDomain{Domain: domain, EmailCount: len(emails)})
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].EmailCount != found[j].EmailCount {
+			return found[i].EmailCount > found[j].EmailCount
+		}
+		return found[i].Domain < found[j].Domain
+	})
+	return found
+}
+
+func contains_string(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+type FmtCounts struct {
+	Emails         int
+	Domains        int
+	ReposListed    uint32
+	ReposWithEmail int
+}
+
+// The summary --count-only prints, the repos listed are the ones the API returned past the filters
+func harvest_counts(emails_grouped *EmailGroups, email_count int) FmtCounts {
+	repos := make(map[*Repo]bool)
+	emails_grouped.ForEach(func(key EmailGroupByRepoKey, _ int8) {
+		repos[key.Repo] = true
+	})
+	return FmtCounts{
+		Emails:         email_count,
+		Domains:        len(emails_grouped.EmailsByDomain()),
+		ReposListed:    atomic.LoadUint32(&total_data[REMOTE_REPOS]),
+		ReposWithEmail: len(repos),
+	}
+}
+
+func write_counts_table(w *tabwriter.Writer, counts FmtCounts) {
+	fmt.Fprintln(w, "Unique emails\t", counts.Emails, "\t")
+	fmt.Fprintln(w, "Domains\t", counts.Domains, "\t")
+	fmt.Fprintln(w, "Repos listed\t", counts.ReposListed, "\t")
+	fmt.Fprintln(w, "Repos with emails\t", counts.ReposWithEmail, "\t")
+	w.Flush()
+}
+
+// The emails ranked by authored commits, for --top
+func write_top_table(w *tabwriter.Writer, top []FmtTopContributor) {
+	fmt.Fprintln(w, "Rank\tEmail\tDomain\tCommits\t")
+	for i, contributor := range top {
+		fmt.Fprintln(w, i+1, "\t", contributor.Email, "\t", contributor.Domain, "\t", contributor.Commits, "\t")
+	}
+	w.Flush()
+}
+
+// The completed counts of every stage when a status table was printed, the next table works out the rates from it
+type StatusSample struct {
+	at        time.Time
+	completed []uint32
+}
+
+// Items per second since the previous sample and the time left for the rest of total at that rate
+// The first table has no previous sample so both are N/A
+func status_rate(previous *StatusSample, current *StatusSample, stage int8, total uint32) (string, string) {
+	if previous == nil {
+		return "N/A", "N/A"
+	}
+	elapsed := current.at.Sub(previous.at).Seconds()
+	completed := current.completed[stage]
+	if elapsed <= 0 || completed < previous.completed[stage] {
+		return "N/A", "N/A"
+	}
+	rate := float64(completed-previous.completed[stage]) / elapsed
+	eta := "N/A"
+	if total <= completed {
+		eta = "0s"
+	} else if rate > 0 {
+		eta = (time.Duration(float64(total-completed)/rate) * time.Second).Round(time.Second).String()
+	}
+	return strconv.FormatFloat(rate, 'f', 1, 64), eta
+}
+
+// One row per stage from the counters, shared by the periodic and final status output
+// Returns the sample to pass to the next call for the rates
+func write_status_table(w *tabwriter.Writer, previous *StatusSample) *StatusSample {
+	current := &StatusSample{at: time.Now(), completed: make([]uint32, len(completion_data))}
+	for stage := range completion_data {
+		current.completed[stage] = atomic.LoadUint32(&completion_data[stage])
+	}
+	pages := atomic.LoadUint32(&total_data[GITHUB_TOTAL_PAGES])
+	remote_repos := atomic.LoadUint32(&total_data[REMOTE_REPOS])
+	local_repos := atomic.LoadUint32(&total_data[LOCAL_REPOS])
+	identities := atomic.LoadUint32(&total_data[GIT_IDENTITIES])
+	fetch_rate, fetch_eta := status_rate(previous, current, GITHUB_FETCH, pages)
+	parse_rate, parse_eta := status_rate(previous, current, GITHUB_PARSE, pages)
+	clone_rate, clone_eta := status_rate(previous, current, GIT_OPS_CLONE, remote_repos)
+	log_rate, log_eta := status_rate(previous, current, GIT_OPS_LOG, local_repos)
+	dedup_rate, dedup_eta := status_rate(previous, current, EMAILS_DEDUP, identities)
+	grouped_rate, grouped_eta := status_rate(previous, current, EMAILS_GROUPED, identities)
+
+	fmt.Fprintln(w, "Stage\tActive\tCompleted\tTotal\tErrors\tRate/s\tETA\t")
+	fmt.Fprintln(w, "Stage 1 - Get Github Repos\t", atomic.LoadUint32(&active_data[GITHUB_FETCH]), "\t", current.completed[GITHUB_FETCH], "\t", pages, "\t", atomic.LoadUint32(&error_data[GITHUB_FETCH]), "\t", fetch_rate, "\t", fetch_eta, "\t")
+	fmt.Fprintln(w, "Stage 2 - Parse URLs\t", atomic.LoadUint32(&active_data[GITHUB_PARSE]), "\t", current.completed[GITHUB_PARSE], "\t", pages, "\t", atomic.LoadUint32(&error_data[GITHUB_PARSE]), "\t", parse_rate, "\t", parse_eta, "\t")
+	fmt.Fprintln(w, "Stage 3 - Clone Repos\t", atomic.LoadUint32(&active_data[GIT_OPS_CLONE]), "\t", current.completed[GIT_OPS_CLONE], "\t", remote_repos, "\t", atomic.LoadUint32(&error_data[GIT_OPS_CLONE]), "\t", clone_rate, "\t", clone_eta, "\t")
+	fmt.Fprintln(w, "Stage 4 - Find Emails\t", atomic.LoadUint32(&active_data[GIT_OPS_LOG]), "\t", current.completed[GIT_OPS_LOG], "\t", local_repos, "\t", atomic.LoadUint32(&error_data[GIT_OPS_LOG]), "\t", log_rate, "\t", log_eta, "\t")
+	fmt.Fprintln(w, "Stage 5a - Dedup Emails\t", "N/A", "\t", current.completed[EMAILS_DEDUP], "\t", identities, "\t", "N/A", "\t", dedup_rate, "\t", dedup_eta, "\t")
+	fmt.Fprintln(w, "Stage 5b - Emails per Repo\t", "N/A", "\t", current.completed[EMAILS_GROUPED], "\t", identities, "\t", "N/A", "\t", grouped_rate, "\t", grouped_eta, "\t")
+	w.Flush()
+	return current
+}
+
+// Finds git in the $PATH when no path was given and checks that it can be run
+func resolve_git_path(git_path string) (string, error) {
+	if git_path == "!None-Provided!" {
+		path, err := exec.LookPath("git")
+		if err != nil {
+			return "", errors.New("Git path not provided and could not find `git` in the $PATH. Install git, pass --git-path or use --no-clone.")
+		}
+		logger.Infof("Git path not provided, using %s.", path)
+		return filepath.Abs(path)
+	}
+	path, err := exec.LookPath(git_path)
+	if err != nil {
+		return "", fmt.Errorf("Could not use %v as git. Error: %v", git_path, err)
+	}
+	return filepath.Abs(path)
+}
+
+// Git reads config from GIT_CONFIG_COUNT since 2.31, older versions silently clone without the token
+const (
+	GIT_CONFIG_ENV_MAJOR int = 2
+	GIT_CONFIG_ENV_MINOR int = 31
+)
+
+// Pulls the major and minor version out of `git --version`, e.g. "git version 2.39.5.windows.1"
+func parse_git_version(output string) (int, int, error) {
+	fields := strings.Fields(output)
+	if len(fields) < 3 || fields[0] != "git" || fields[1] != "version" {
+		return 0, 0, fmt.Errorf("unexpected git --version output %q", strings.TrimSpace(output))
+	}
+	parts := strings.SplitN(fields[2], ".", 3)
+	if len(parts) < 2 {
+		return 0, 0, fmt.Errorf("unexpected git version %q", fields[2])
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("unexpected git version %q", fields[2])
+	}
+	minor, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, fmt.Errorf("unexpected git version %q", fields[2])
+	}
+	return major, minor, nil
+}
+
+// Fails when the git can't take the clone token from the environment
+func check_git_version(git_path string) error {
+	output, err := exec.Command(git_path, "--version").Output()
+	if err != nil {
+		return fmt.Errorf("Could not run %v --version. Error: %v", git_path, err)
+	}
+	major, minor, err := parse_git_version(string(output))
+	if err != nil {
+		return err
+	}
+	if major < GIT_CONFIG_ENV_MAJOR || (major == GIT_CONFIG_ENV_MAJOR && minor < GIT_CONFIG_ENV_MINOR) {
+		return fmt.Errorf("git %d.%d can't be given the --token to clone with, it needs %d.%d or newer. Upgrade git or clone with --use-git-credentials.", major, minor, GIT_CONFIG_ENV_MAJOR, GIT_CONFIG_ENV_MINOR)
+	}
+	return nil
+}
+
+// Total errors across every stage
+func stage_error_count() uint32 {
+	var total uint32
+	for index := range error_data {
+		total += atomic.LoadUint32(&error_data[index])
+	}
+	return total
+}
+
+func init() {
+	if runtime.GOOS == "windows" {
+		LINE_SEP = "\r\n"
+	} else {
+		LINE_SEP = "\n"
+	}
+}
+
+// Parses and checks the command line, exiting with the help on a bad one
+// Called from main rather than init so the tests don't parse the test flags
+func parse_options() {
+	parser.AddCommand("harvest", "Harvest the emails of a user, org or url",
+		"Lists the repos of the target, clones them and pulls the emails out of the history. This is the default when no command is given.", &opts)
+	parser.AddCommand("diff", "Compare the JSON outputs of two runs",
+		"Lists the emails and repos that were added or removed between two --json outputs, the same as --baseline/--diff without a harvest.", &diff_opts)
+	parser.AddCommand("decrypt", "Decrypt an --encrypt output to stdout", "", &decrypt_opts)
+	parser.AddGroup("Global Options", "", &global_opts)
+	// A command is still needed unless only listing the sources, that is checked below
+	parser.SubcommandsOptional = true
+
+	args, err := parser.ParseArgs(default_command(os.Args[1:]))
+	if err != nil {
+		if flagsErr, ok := err.(*flags.Error); ok && flagsErr.Type == flags.ErrHelp {
+			os.Exit(0)
+		} else {
+			parser.WriteHelp(os.Stderr)
+			os.Exit(1)
+		}
+	}
+	if len(args) > 0 {
+		fmt.Fprintf(os.Stderr, "Unexpected arguments found: %s\n", strings.Join(args, " "))
+		parser.WriteHelp(os.Stderr)
+		os.Exit(1)
+	}
+	if global_opts.ListSources {
+		list_sources(os.Stdout)
+		os.Exit(0)
+	}
+	if parser.Active == nil {
+		fmt.Fprintln(os.Stderr, "Please specify one command of: decrypt, diff or harvest")
+		parser.WriteHelp(os.Stderr)
+		os.Exit(1)
+	}
+	if parser.Active.Name == "decrypt" {
+		// Nothing else is needed to decrypt
+		return
+	}
+	if parser.Active.Name == "diff" {
+		if diff_opts.Encrypt && len(diff_opts.Passphrase) == 0 {
+			fmt.Fprintln(os.Stderr, "Please provide a passphrase with --passphrase or $REPOHARVESTER_PASSPHRASE")
+			parser.WriteHelp(os.Stderr)
+			os.Exit(1)
+		}
+		return
+	}
+	if opts.Output.Encrypt && len(opts.Output.Passphrase) == 0 {
+		fmt.Fprintln(os.Stderr, "Please provide a passphrase with --passphrase or $REPOHARVESTER_PASSPHRASE")
+		parser.WriteHelp(os.Stderr)
+		os.Exit(1)
+	}
+	if (len(opts.Output.Baseline) > 0) != (len(opts.Output.DiffFile) > 0) {
+		fmt.Fprintln(os.Stderr, "Please provide both --baseline and --diff")
+		parser.WriteHelp(os.Stderr)
+		os.Exit(1)
+	}
+	if opts.Output.CountOnly && (len(opts.Output.OutputJson) > 0 || len(opts.Output.OutputFile) > 0 || len(opts.Output.Combined) > 0) {
+		fmt.Fprintln(os.Stderr, "--count-only prints the counts instead of writing the --json, --file and --combined outputs")
+		parser.WriteHelp(os.Stderr)
+		os.Exit(1)
+	}
+	// The --combined holds both, otherwise they come as a pair
+	if !opts.Output.CountOnly && len(opts.Output.Combined) == 0 && (len(opts.Output.OutputJson) == 0 || len(opts.Output.OutputFile) == 0) {
+		fmt.Fprintln(os.Stderr, "Please provide both the --json and --file outputs, or a --combined output")
+		parser.WriteHelp(os.Stderr)
 		os.Exit(1)
 	}
+	if err := check_type_options(opts.Resource); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		parser.WriteHelp(os.Stderr)
+		os.Exit(1)
+	}
+	// The requests are logged at debug level
+	if opts.Application.VerboseHttp {
+		opts.Application.Verbose = true
+	}
 	if opts.Application.Quiet && opts.Application.Verbose {
 		fmt.Fprintln(os.Stderr, "You can't have it both ways, quiet and verbose")
 		parser.WriteHelp(os.Stderr)
@@ -1012,8 +5620,69 @@ func init() {
 
 }
 
+// Requires exactly one of --user, --org, --url or --type
+// Chained != is a parity check, not mutual exclusion, so count what was set instead
+func check_type_options(resource ResourceOptions) error {
+	var type_options []string
+	if resource.User {
+		type_options = append(type_options, "--user")
+	}
+	if resource.Org {
+		type_options = append(type_options, "--org")
+	}
+	if resource.Url {
+		type_options = append(type_options, "--url")
+	}
+	if len(resource.Type) > 0 {
+		type_options = append(type_options, "--type "+resource.Type)
+	}
+	if len(type_options) == 0 {
+		return errors.New("Please provide either org, user or url as the target type")
+	}
+	if len(type_options) > 1 {
+		return errors.New("Please use only one setting: --user, --org, --url or --type <type>. Got: " + strings.Join(type_options, ", "))
+	}
+	return nil
+}
+
+// The decrypt command, writes the plaintext of an --encrypt output to stdout
+func decrypt_command() {
+	file := string(decrypt_opts.Args.File)
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		logger.Fatal(fmt.Sprintf("Could not read %v. Error: %v", file, err))
+	}
+	plaintext, err := decrypt_data(decrypt_opts.Passphrase, data)
+	if err != nil {
+		logger.Fatal(fmt.Sprintf("Could not decrypt %v. Error: %v", file, err))
+	}
+	os.Stdout.Write(plaintext)
+}
+
+// The diff command, compares two --json outputs without harvesting
+func diff_command() {
+	previous, err := load_baseline(string(diff_opts.Args.Previous), diff_opts.Passphrase)
+	if err != nil {
+		logger.Fatal(fmt.Sprintf("Could not load %v. Error: %v", diff_opts.Args.Previous, err))
+	}
+	current, err := load_baseline(string(diff_opts.Args.Current), diff_opts.Passphrase)
+	if err != nil {
+		logger.Fatal(fmt.Sprintf("Could not load %v. Error: %v", diff_opts.Args.Current, err))
+	}
+	diff_file := string(diff_opts.DiffFile)
+	if diff_opts.Encrypt {
+		OUTPUT_PASSPHRASE = diff_opts.Passphrase
+		diff_file += ENCRYPTED_EXTENSION
+	}
+	if err = write_baseline_diff(diff_file, previous, current); err != nil {
+		logger.Fatal(fmt.Sprintf("Could not write the diff %v. Error: %v", diff_file, err))
+	}
+}
+
 func main() {
 
+	parse_options()
+
 	// Set up a global buffer pool for all functions to use
 	g_buff_pool = sync.Pool{
 		New: func() interface{} {
@@ -1021,127 +5690,588 @@ func main() {
 		},
 	}
 
-	var (
-		err         error
-		working_dir string
-		target_type string
-		git_path    string
-		NUM_WORKERS int8
-		output_file string
-		output_json string
-		ok          bool
-		size_filter uint64
-	)
+	var (
+		err              error
+		working_dir      string
+		target_type      string
+		git_path         string
+		NUM_WORKERS      int8
+		output_file      string
+		output_json      string
+		ok               bool
+		size_filter      uint64
+		owner_filter     map[string]bool
+		domain_allowlist map[string]bool
+		known_domains    map[string]bool
+		target_domains   map[string]bool
+		raw_shortlog_dir string
+		per_repo_dir     string
+		widespread_file  string
+		errors_file      string
+		trace_file       string
+		fetch_log_file   string
+		graph_file       string
+		diff_file        string
+		activity_file    string
+		no_identity_file string
+		emails_only_file string
+		names_file       string
+		combined_file    string
+		report_file      string
+		enterprise       bool
+		baseline         *Baseline
+	)
+
+	LOG_TIMESTAMPS = opts.Application.LogTimestamps == "true"
+	if opts.Application.Verbose {
+		logger.set_level(LOG_DEBUG)
+	} else if opts.Application.Quiet {
+		logger.set_level(LOG_ERROR)
+	} else {
+		logger.set_level(LOG_INFO)
+	}
+	defer logger.Wait()
+
+	switch parser.Active.Name {
+	case "decrypt":
+		decrypt_command()
+		return
+	case "diff":
+		diff_command()
+		return
+	}
+
+	// Without a --working-dir each run gets its own so concurrent harvests from the same directory don't collide
+	generated_working_dir := false
+	if opts.Application.WorkingDir == "!None-Provided!" {
+		working_path, err := os.Getwd()
+		if err != nil {
+			logger.Fatal(fmt.Sprintf("Working directory not provided and could not retrive a directory to use. Error: %s", err))
+		}
+		logger.Debugf("Working directory found: %s", working_path)
+		if opts.Application.ReuseClones {
+			// The clones are only found again under a fixed name
+			opts.Application.WorkingDir = flags.Filename(filepath.Join(working_path, "working_dir"))
+		} else {
+			opts.Application.WorkingDir = flags.Filename(filepath.Join(working_path, fmt.Sprintf("working_dir-%s-%d", time.Now().Format("20060102T150405"), os.Getpid())))
+			generated_working_dir = true
+		}
+		logger.Infof("Working directory not provided, using %s.", opts.Application.WorkingDir)
+	}
+	if opts.Advanced.QueueSize < 1 {
+		logger.Error("Queue size is too small, resetting to 20")
+		opts.Advanced.QueueSize = 20
+	}
+	if opts.Advanced.Workers < 1 {
+		logger.Error("Too few workers assigned, resetting to 20")
+		opts.Advanced.Workers = 20
+	}
+	if opts.Resource.User {
+		target_type = "users"
+	} else if opts.Resource.Org {
+		target_type = "orgs"
+	} else if opts.Resource.Url {
+		target_type = "url"
+	} else {
+		switch opts.Resource.Type {
+		case "org":
+			target_type = "orgs"
+		case "user":
+			target_type = "users"
+		case "url":
+			target_type = "url"
+		case "azure-devops":
+			target_type = "azure-devops"
+		case "enterprise":
+			// The enterprise's orgs are harvested like any other org target
+			target_type = "orgs"
+			enterprise = true
+		case "gitlab":
+			target_type = "gitlab"
+		}
+	}
+	if len(target_type) < 3 {
+		logger.Panic("Not actually sure what happened here. Please open a bug report")
+	}
+	if opts.Resource.SizeFilter <= 0 {
+		logger.Info("Disabling size filter for cloning")
+		size_filter = 0
+	} else {
+		size_filter = opts.Resource.SizeFilter
+	}
+	if opts.Resource.OwnerOnly {
+		if target_type != "users" && target_type != "orgs" {
+			logger.Fatal("--owner-only can only be used with user or org targets")
+		}
+		owner_filter = map[string]bool{strings.ToLower(opts.Args.TargetName): true}
+	}
+	if len(opts.Output.DomainAllowlist) > 0 {
+		domain_allowlist = make(map[string]bool)
+		for _, domain := range strings.Split(opts.Output.DomainAllowlist, ",") {
+			domain = normalize_domain(strings.TrimSpace(domain))
+			if len(domain) > 0 {
+				domain_allowlist[domain] = true
+			}
+		}
+	}
+	if len(opts.Output.TargetDomains) > 0 {
+		target_domains = make(map[string]bool)
+		for _, domain := range strings.Split(opts.Output.TargetDomains, ",") {
+			domain = normalize_domain(strings.TrimSpace(domain))
+			if len(domain) > 0 {
+				target_domains[domain] = true
+			}
+		}
+	}
+	if len(opts.Output.KnownDomains) > 0 {
+		known_domains, err = load_known_domains(string(opts.Output.KnownDomains))
+		if err != nil {
+			logger.Fatal(fmt.Sprintf("Could not read %v. Error: %v", opts.Output.KnownDomains, err))
+		}
+	}
+	if len(opts.Advanced.WebhookUrl) > 0 {
+		parsed_webhook, err := url.Parse(opts.Advanced.WebhookUrl)
+		if err != nil || (parsed_webhook.Scheme != "http" && parsed_webhook.Scheme != "https") {
+			logger.Fatal("--webhook-url must be an http or https URL")
+		}
+	}
+	if opts.Advanced.PerPage < 1 || opts.Advanced.PerPage > GITHUB_MAX_PER_PAGE {
+		logger.Fatal(fmt.Sprintf("--per-page has to be between 1 and %d", GITHUB_MAX_PER_PAGE))
+	}
+	PER_PAGE = opts.Advanced.PerPage
+	if opts.Advanced.PathTemplate != GITHUB_REPOS_PATH_TEMPLATE {
+		if target_type != "users" && target_type != "orgs" {
+			logger.Fatal("--path-template can only be used with user or org targets")
+		}
+		if !strings.HasPrefix(opts.Advanced.PathTemplate, "/") {
+			logger.Fatal("--path-template has to start with a /")
+		}
+	}
+	if enterprise && opts.Resource.Search {
+		logger.Fatal("--search can't be used with enterprise targets")
+	}
+	if opts.Advanced.SincePaging && (target_type == "azure-devops" || target_type == "gitlab") {
+		logger.Fatal("--since-paging can only be used with GitHub targets")
+	}
+	app_auth := opts.Resource.AppId > 0 || opts.Resource.AppInstall > 0 || len(opts.Resource.AppKey) > 0
+	if app_auth {
+		if opts.Resource.AppId == 0 || opts.Resource.AppInstall == 0 || len(opts.Resource.AppKey) == 0 {
+			logger.Fatal("GitHub App auth needs all of --app-id, --app-installation-id and --app-key")
+		}
+		if len(opts.Resource.Token) > 0 {
+			logger.Fatal("--token can't be used with GitHub App auth")
+		}
+		if target_type == "azure-devops" || target_type == "gitlab" || enterprise {
+			logger.Fatal("GitHub App auth can only be used with GitHub user, org and url targets")
+		}
+	}
+	if enterprise && len(opts.Resource.Token) == 0 {
+		logger.Fatal("Enterprise targets need a --token with the read:enterprise scope")
+	}
+	exclude_paths := opts.Application.ExcludePaths
+	if opts.Application.ExcludeVendor {
+		exclude_paths = append(exclude_paths, VENDOR_PATHS...)
+	}
+	if opts.Application.ByDirectory < 0 {
+		logger.Fatal("--by-directory must be a depth of 1 or more")
+	}
+	// Only shallow clones are deepened, so the threshold makes them shallow unless the clone args already do
+	var default_depth int
+	if opts.Application.DeepenThreshold > 0 {
+		default_depth = DEEPEN_DEFAULT_DEPTH
+	}
+	// Both limit the shortlogs by path, which needs the trees
+	clone_args, err := git_clone_args(opts.Application.GitCloneArgs, len(exclude_paths) > 0 || opts.Application.ByDirectory > 0, default_depth)
+	if err != nil {
+		logger.Fatal("--git-clone-args: ", err)
+	}
+	if opts.Resource.Search && target_type != "users" && target_type != "orgs" {
+		logger.Fatal("--search can only be used with user or org targets")
+	}
+	if opts.Application.NoClone {
+		if target_type == "azure-devops" {
+			logger.Fatal("--no-clone can only be used with GitHub targets")
+		}
+		if opts.Application.WithBlame || opts.Application.IncludeTags || len(opts.Output.Activity) > 0 || len(opts.Output.RawShortlogDir) > 0 || len(opts.Output.NoIdentityRepos) > 0 || opts.Application.ExcludeVendor || len(opts.Application.ExcludePaths) > 0 || opts.Application.ByDirectory > 0 {
+			logger.Fatal("--with-blame, --include-tags, --activity, --raw-shortlog-dir, --no-identity-repos, --exclude-vendor, --exclude-path and --by-directory need the repos cloned and can't be used with --no-clone")
+		}
+	}
+	if opts.Application.GraphQL {
+		if !opts.Application.NoClone || (target_type != "users" && target_type != "orgs") {
+			logger.Fatal("--graphql needs --no-clone and a user, org or enterprise target on github.com")
+		}
+		if len(opts.Resource.Token) == 0 && !app_auth {
+			logger.Fatal("--graphql needs a --token or GitHub App auth, the GraphQL API doesn't allow anonymous requests")
+		}
+	}
+	if opts.Application.PrAuthors && (target_type == "azure-devops" || target_type == "gitlab") {
+		logger.Fatal("--pr-authors can only be used with GitHub targets")
+	}
+	if opts.Application.DeepenThreshold > 0 && opts.Application.NoClone {
+		logger.Fatal("--deepen-threshold can't be used with --no-clone")
+	}
+	if opts.Application.ReuseClones {
+		if opts.Application.NoClone {
+			logger.Fatal("--reuse-clones can't be used with --no-clone")
+		}
+		if opts.Application.CleanupClones {
+			logger.Fatal("--cleanup-clones can't be used with --reuse-clones")
+		}
+		if !opts.Application.PreserveDir {
+			logger.Info("The working dir is removed at the end of the run, add --preserve-dir to reuse the clones next time")
+		}
+	}
+	if opts.Resource.MinStars > 0 && target_type == "azure-devops" {
+		logger.Fatal("--min-stars can only be used with GitHub targets")
+	}
+	topic_filter := make(map[string]bool)
+	for _, topic := range opts.Resource.Topics {
+		topic_filter[strings.ToLower(topic)] = true
+	}
+	topic_exclude := make(map[string]bool)
+	for _, topic := range opts.Resource.SkipTopics {
+		topic_exclude[strings.ToLower(topic)] = true
+	}
+	if len(topic_filter)+len(topic_exclude) > 0 && target_type == "azure-devops" {
+		logger.Fatal("--topic and --exclude-topic can only be used with GitHub and GitLab targets")
+	}
+	if opts.Resource.WithWikis && (target_type == "azure-devops" || opts.Application.NoClone) {
+		logger.Fatal("--include-wiki can only be used with GitHub targets that are cloned")
+	}
+	if opts.Resource.MemberRepos && target_type != "orgs" {
+		logger.Fatal("--include-member-repos can only be used with org and enterprise targets")
+	}
+	if opts.Resource.Subgroups && target_type != "gitlab" {
+		logger.Fatal("--include-subgroups can only be used with gitlab targets")
+	}
+	if target_type == "gitlab" && (opts.Resource.Search || opts.Resource.WithForks || opts.Resource.WithWikis || opts.Application.NoClone) {
+		logger.Fatal("--search, --include-fork-contributors, --include-wiki and --no-clone can't be used with gitlab targets")
+	}
+	if opts.Resource.WithForks && target_type == "azure-devops" {
+		logger.Fatal("--include-fork-contributors can only be used with GitHub targets")
+	}
+	if opts.Resource.NoMirrors && (target_type == "azure-devops" || target_type == "gitlab") {
+		logger.Fatal("--no-mirrors can only be used with GitHub targets")
+	}
+
+	working_dir = string(opts.Application.WorkingDir)
+	SPILL_DIR = working_dir
+	SPILL_THRESHOLD = opts.Advanced.SpillThreshold
+	if opts.Application.StatusInterval < 0 {
+		logger.Fatal("--status-interval can't be negative")
+	}
+	if opts.Advanced.AggregateWorkers < 1 {
+		logger.Fatal("--aggregate-workers has to be at least 1")
+	}
+	if opts.Advanced.AggregateWorkers > 1 && SPILL_THRESHOLD > 0 {
+		logger.Fatal("--aggregate-workers can't be used with --spill-threshold")
+	}
+	output_file = string(opts.Output.OutputFile)
+	output_json = string(opts.Output.OutputJson)
+	widespread_file = string(opts.Output.Widespread)
+	errors_file = string(opts.Output.ErrorsFile)
+	trace_file = string(opts.Output.Trace)
+	fetch_log_file = string(opts.Output.FetchLog)
+	graph_file = string(opts.Output.Graph)
+	diff_file = string(opts.Output.DiffFile)
+	activity_file = string(opts.Output.Activity)
+	no_identity_file = string(opts.Output.NoIdentityRepos)
+	emails_only_file = string(opts.Output.EmailsOnly)
+	names_file = string(opts.Output.Names)
+	combined_file = string(opts.Output.Combined)
+	report_file = string(opts.Output.Report)
+	// Compressed before they are encrypted, e.g. output.json.gz.enc
+	output_extension := ""
+	if opts.Output.Gzip {
+		OUTPUT_GZIP = true
+		output_extension += GZIP_EXTENSION
+	}
+	if opts.Output.Encrypt {
+		OUTPUT_PASSPHRASE = opts.Output.Passphrase
+		output_extension += ENCRYPTED_EXTENSION
+	}
+	if len(output_extension) > 0 {
+		// Either can be left out with a --combined
+		if len(output_file) > 0 {
+			output_file += output_extension
+		}
+		if len(output_json) > 0 {
+			output_json += output_extension
+		}
+		if len(widespread_file) > 0 {
+			widespread_file += output_extension
+		}
+		if len(errors_file) > 0 {
+			errors_file += output_extension
+		}
+		if len(trace_file) > 0 {
+			trace_file += output_extension
+		}
+		if len(fetch_log_file) > 0 {
+			fetch_log_file += output_extension
+		}
+		if len(graph_file) > 0 {
+			graph_file += output_extension
+		}
+		if len(diff_file) > 0 {
+			diff_file += output_extension
+		}
+		if len(activity_file) > 0 {
+			activity_file += output_extension
+		}
+		if len(no_identity_file) > 0 {
+			no_identity_file += output_extension
+		}
+		if len(emails_only_file) > 0 {
+			emails_only_file += output_extension
+		}
+		if len(names_file) > 0 {
+			names_file += output_extension
+		}
+		if len(combined_file) > 0 {
+			combined_file += output_extension
+		}
+		if len(report_file) > 0 {
+			report_file += output_extension
+		}
+	}
+	if len(opts.Output.Baseline) > 0 {
+		// Loaded up front so a bad baseline fails before the harvest rather than after
+		baseline, err = load_baseline(string(opts.Output.Baseline), opts.Output.Passphrase)
+		if err != nil {
+			logger.Fatal(fmt.Sprintf("Could not load the baseline %v. Error: %v", opts.Output.Baseline, err))
+		}
+		logger.Info("Loaded the baseline with ", len(baseline.Emails), " emails and ", len(baseline.Repos), " repos")
+	}
+
+	if generated_working_dir {
+		// Created exclusively, a dir that already exists belongs to another run
+		err = os.Mkdir(working_dir, 0700)
+		ok = err == nil
+	} else {
+		ok, err = check_working_dir(working_dir)
+	}
+	// The clones of the last run are expected to be there when reusing them
+	if !ok && !(opts.Application.ReuseClones && err == nil) {
+		if err == nil {
+			logger.Fatal(fmt.Sprintf("%v is not empty", working_dir))
+		} else {
+			logger.Panic(fmt.Sprintf("Cannot use %v. Error: %v", working_dir, err))
+		}
+	}
+
+	if len(opts.Output.PerRepoDir) > 0 {
+		per_repo_dir = string(opts.Output.PerRepoDir)
+		err = os.MkdirAll(per_repo_dir, 0700)
+		if err != nil {
+			logger.Fatal(fmt.Sprintf("Could not create %v. Error: %v", per_repo_dir, err))
+		}
+	}
+
+	if len(opts.Output.RawShortlogDir) > 0 {
+		raw_shortlog_dir = string(opts.Output.RawShortlogDir)
+		err = os.MkdirAll(raw_shortlog_dir, 0700)
+		if err != nil {
+			logger.Fatal(fmt.Sprintf("Could not create %v. Error: %v", raw_shortlog_dir, err))
+		}
+	}
+
+	// Both are required unless --count-only or a --combined
+	if len(output_file) > 0 {
+		ok, err = check_ouput_location(output_file)
+		if !ok {
+			logger.Fatal(fmt.Sprintf("Could not create %v. Error: %v", output_file, err))
+		}
+	}
+
+	if len(output_json) > 0 {
+		ok, err = check_ouput_location(output_json)
+		if !ok {
+			logger.Fatal(fmt.Sprintf("Could not create %v. Error: %v", output_json, err))
+		}
+	}
 
-	if opts.Application.Verbose {
-		logger.set_level(LOG_DEBUG)
-	} else if opts.Application.Quiet {
-		logger.set_level(LOG_ERROR)
-	} else {
-		logger.set_level(LOG_INFO)
+	if len(widespread_file) > 0 {
+		ok, err = check_ouput_location(widespread_file)
+		if !ok {
+			logger.Fatal(fmt.Sprintf("Could not create %v. Error: %v", widespread_file, err))
+		}
 	}
-	defer logger.Wait()
 
-	if opts.Application.WorkingDir == "!None-Provided!" {
-		working_path, err := os.Getwd()
-		if err != nil {
-			logger.Fatal(fmt.Sprintf("Working directory not provided and could not retrive a directory to use. Error: %s", err))
+	if len(errors_file) > 0 {
+		ok, err = check_ouput_location(errors_file)
+		if !ok {
+			logger.Fatal(fmt.Sprintf("Could not create %v. Error: %v", errors_file, err))
 		}
-		logger.Debugf("Working directory found: %s", working_path)
-		opts.Application.WorkingDir = flags.Filename(filepath.Join(working_path, "working_dir"))
-		logger.Infof("Working directory not provided, using %s.", opts.Application.WorkingDir)
 	}
-	if opts.Application.GitPath == "!None-Provided!" {
-		path, err := exec.LookPath("git")
-		if err != nil {
-			logger.Fatal("Git path not provided and could not find `git` in the $PATH.")
+
+	if len(trace_file) > 0 {
+		ok, err = check_ouput_location(trace_file)
+		if !ok {
+			logger.Fatal(fmt.Sprintf("Could not create %v. Error: %v", trace_file, err))
 		}
-		opts.Application.GitPath = flags.Filename(path)
-		logger.Infof("Git path not provided, using %s.", opts.Application.GitPath)
+		g_trace.enabled = true
 	}
-	if opts.Advanced.QueueSize < 1 {
-		logger.Error("Queue size is too small, resetting to 20")
-		opts.Advanced.QueueSize = 20
+
+	if len(fetch_log_file) > 0 {
+		ok, err = check_ouput_location(fetch_log_file)
+		if !ok {
+			logger.Fatal(fmt.Sprintf("Could not create %v. Error: %v", fetch_log_file, err))
+		}
+		g_fetch_log.enabled = true
 	}
-	if opts.Advanced.Workers < 1 {
-		logger.Error("Too few workers assigned, resetting to 20")
-		opts.Advanced.Workers = 20
+
+	if len(graph_file) > 0 {
+		ok, err = check_ouput_location(graph_file)
+		if !ok {
+			logger.Fatal(fmt.Sprintf("Could not create %v. Error: %v", graph_file, err))
+		}
 	}
-	if opts.Resource.User {
-		target_type = "users"
-	} else if opts.Resource.Org {
-		target_type = "orgs"
-	} else if opts.Resource.Url {
-		target_type = "url"
-	} else {
-		switch opts.Resource.Type {
-		case "org":
-			target_type = "orgs"
-		case "user":
-			target_type = "users"
-		case "url":
-			target_type = "url"
+
+	if len(diff_file) > 0 {
+		ok, err = check_ouput_location(diff_file)
+		if !ok {
+			logger.Fatal(fmt.Sprintf("Could not create %v. Error: %v", diff_file, err))
 		}
 	}
-	if len(target_type) < 3 {
-		logger.Panic("Not actually sure what happened here. Please open a bug report")
+
+	if len(emails_only_file) > 0 {
+		ok, err = check_ouput_location(emails_only_file)
+		if !ok {
+			logger.Fatal(fmt.Sprintf("Could not create %v. Error: %v", emails_only_file, err))
+		}
 	}
-	if opts.Resource.SizeFilter <= 0 {
-		logger.Info("Disabling size filter for cloning")
-		size_filter = 0
-	} else {
-		size_filter = opts.Resource.SizeFilter
+
+	if len(names_file) > 0 {
+		ok, err = check_ouput_location(names_file)
+		if !ok {
+			logger.Fatal(fmt.Sprintf("Could not create %v. Error: %v", names_file, err))
+		}
 	}
 
-	working_dir = string(opts.Application.WorkingDir)
-	output_file = string(opts.Output.OutputFile)
-	output_json = string(opts.Output.OutputJson)
+	if len(combined_file) > 0 {
+		ok, err = check_ouput_location(combined_file)
+		if !ok {
+			logger.Fatal(fmt.Sprintf("Could not create %v. Error: %v", combined_file, err))
+		}
+	}
 
-	ok, err = check_working_dir(working_dir)
-	if !ok {
-		if err == nil {
-			logger.Fatal(fmt.Sprintf("%v is not empty", working_dir))
-		} else {
-			logger.Panic(fmt.Sprintf("Cannot use %v. Error: %v", working_dir, err))
+	if len(report_file) > 0 {
+		ok, err = check_ouput_location(report_file)
+		if !ok {
+			logger.Fatal(fmt.Sprintf("Could not create %v. Error: %v", report_file, err))
 		}
 	}
 
-	ok, err = check_ouput_location(output_file)
-	if !ok {
-		logger.Fatal(fmt.Sprintf("Could not create %v. Error: %v", output_file, err))
+	if len(no_identity_file) > 0 {
+		ok, err = check_ouput_location(no_identity_file)
+		if !ok {
+			logger.Fatal(fmt.Sprintf("Could not create %v. Error: %v", no_identity_file, err))
+		}
 	}
 
-	ok, err = check_ouput_location(output_json)
-	if !ok {
-		logger.Fatal(fmt.Sprintf("Could not create %v. Error: %v", output_json, err))
+	if len(activity_file) > 0 {
+		ok, err = check_ouput_location(activity_file)
+		if !ok {
+			logger.Fatal(fmt.Sprintf("Could not create %v. Error: %v", activity_file, err))
+		}
 	}
 
 	BUFFER_SIZE = opts.Advanced.QueueSize
+	PAGE_BUFFER_SIZE = BUFFER_SIZE
+	if opts.Advanced.PageQueueSize > 0 {
+		PAGE_BUFFER_SIZE = opts.Advanced.PageQueueSize
+	}
+	REPO_BUFFER_SIZE = BUFFER_SIZE
+	if opts.Advanced.RepoQueueSize > 0 {
+		REPO_BUFFER_SIZE = opts.Advanced.RepoQueueSize
+	}
+	IDENTITY_BUFFER_SIZE = BUFFER_SIZE * IDENTITY_QUEUE_MULTIPLIER
+	if opts.Advanced.IdentityQueueSize > 0 {
+		IDENTITY_BUFFER_SIZE = opts.Advanced.IdentityQueueSize
+	}
+	logger.Debugf("Queue sizes - pages: %d, repos: %d, identities: %d", PAGE_BUFFER_SIZE, REPO_BUFFER_SIZE, IDENTITY_BUFFER_SIZE)
 
 	NUM_WORKERS = opts.Advanced.Workers
+	if opts.Application.AuthorsOnly {
+		SHORTLOG_PASSES = 1
+	}
+	if opts.Application.IncludeTags {
+		SHORTLOG_PASSES++
+	}
 
-	var url string
-	if target_type != "url" {
-		var url_base string = "https://api.github.com/{target-type}/{target-name}/repos?per_page=100"
-		r := strings.NewReplacer("{target-type}", target_type, "{target-name}", opts.Args.TargetName)
+	API_TOKEN = opts.Resource.Token
+	if app_auth {
+		key, err := load_app_key(opts.Resource.AppKey)
+		if err != nil {
+			logger.Fatal(fmt.Sprintf("Could not load the GitHub App key %v. Error: %v", opts.Resource.AppKey, err))
+		}
+		g_app_token = &AppToken{app_id: opts.Resource.AppId, installation_id: opts.Resource.AppInstall, key: key}
+	}
+	if opts.Output.WithVisibility && len(API_TOKEN) == 0 && !app_auth {
+		logger.Info("No token provided, only public repos are listed so every email will show as public")
+	}
+
+	// Let the API scope the listing rather than filtering client side
+	var repo_query string
+	if len(opts.Resource.RepoType) > 0 {
+		allowed := REPO_TYPES_ORG
+		if target_type == "users" {
+			allowed = REPO_TYPES_USER
+		}
+		if target_type != "users" && target_type != "orgs" {
+			logger.Fatal("--repo-type can only be used with user or org targets")
+		}
+		if !contains_string(allowed, opts.Resource.RepoType) {
+			logger.Fatal(fmt.Sprintf("--repo-type for %s must be one of: %s", target_type, strings.Join(allowed, ", ")))
+		}
+		repo_query += "&type=" + url.QueryEscape(opts.Resource.RepoType)
+	}
+	if len(opts.Resource.Affiliation) > 0 {
+		if target_type != "users" {
+			logger.Fatal("--affiliation can only be used with user targets")
+		}
+		for _, affiliation := range strings.Split(opts.Resource.Affiliation, ",") {
+			if !contains_string(REPO_AFFILIATION, affiliation) {
+				logger.Fatal(fmt.Sprintf("--affiliation must be a comma separated list of: %s", strings.Join(REPO_AFFILIATION, ", ")))
+			}
+		}
+		repo_query += "&affiliation=" + url.QueryEscape(opts.Resource.Affiliation)
+	}
 
+	var url string
+	if target_type == "azure-devops" {
+		if len(API_TOKEN) == 0 {
+			logger.Info("No token provided, only public Azure DevOps projects will be listed")
+		}
+		url = "https://dev.azure.com/" + opts.Args.TargetName + "/_apis/git/repositories?api-version=6.0"
+	} else if target_type == "gitlab" {
+		// The group is addressed by its url encoded path. Ordered by id so the pages stay stable while the larger subgroup listing is paged through
+		url = strings.TrimSuffix(opts.Resource.GitlabUrl, "/") + "/api/v4/groups/" + strings.ReplaceAll(opts.Args.TargetName, "/", "%2F") + "/projects?order_by=id&sort=asc&per_page=" + strconv.Itoa(PER_PAGE)
+		if opts.Resource.Subgroups {
+			url += "&include_subgroups=true"
+		}
+	} else if target_type != "url" {
 		// Add the org name to the URL
-		url = r.Replace(url_base)
+		url = github_repos_url(opts.Advanced.PathTemplate, target_type, opts.Args.TargetName) + repo_query
 	} else {
 		url = opts.Args.TargetName
 	}
 
 	//var output_dir string = "/mnt/shared/python/output_dir"
 
-	git_path, err = filepath.Abs(string(opts.Application.GitPath))
-	if err != nil {
-		logger.Panic(fmt.Sprintf("%v", err))
-	}
-
 	// Set up global semaphore for the system
 	g_semaphore = semaphore.NewWeighted(int64(NUM_WORKERS))
+	live_work := opts.Advanced.MaxLiveWork
+	if live_work <= 0 {
+		live_work = int(NUM_WORKERS)
+	} else if live_work < int(NUM_WORKERS) {
+		logger.Info("--max-live-work is below --workers, at most ", live_work, " work goroutines will run at once")
+	}
+	g_live_work = semaphore.NewWeighted(int64(live_work))
 
 	logger.Info("Starting...")
+	start_time := time.Now()
 
 	completion_data = make([]uint32, 6)
 	error_data = make([]uint32, 6)
@@ -1151,25 +6281,191 @@ func main() {
 	// Set up a context to allow for an exit to still write a file
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	// Both are in place before any work is dispatched
+	handle_pause_signals(ctx)
+	g_watchdog.run(ctx, opts.Advanced.StallWarning, opts.Advanced.StallKill)
+
+	if len(opts.Advanced.MetricsAddr) > 0 {
+		start_metrics_server(ctx, opts.Advanced.MetricsAddr)
+	}
+
+	var transport http.RoundTripper = http.DefaultTransport
+	if opts.Application.VerboseHttp {
+		transport = &LoggingTransport{transport: transport}
+	}
+	user_agent := opts.Advanced.UserAgent
+	if len(user_agent) == 0 {
+		user_agent = "repoharvester/" + VERSION
+	}
+	g_http_client = &http.Client{Transport: &UserAgentTransport{transport: transport, user_agent: user_agent}}
+	FETCH_RETRIES = opts.Advanced.FetchRetries
+	FETCH_BACKOFF = opts.Advanced.FetchBackoff
+	if opts.Advanced.ApiRate > 0 {
+		g_api_limiter = rate.NewLimiter(rate.Limit(opts.Advanced.ApiRate), 1)
+	} else {
+		logger.Info("Disabling API rate limit")
+		g_api_limiter = rate.NewLimiter(rate.Inf, 0)
+	}
+
+	if g_app_token != nil {
+		if err := g_app_token.refresh(ctx); err != nil {
+			logger.Fatal(fmt.Sprintf("Could not get an installation token for the GitHub App. Error: %v", err))
+		}
+		go g_app_token.keep_fresh(ctx)
+	}
+
+	if target_type == "users" || target_type == "orgs" {
+		if err := check_github_auth(ctx); err != nil {
+			logger.Fatal(fmt.Sprintf("Could not use the GitHub API. Error: %v", err))
+		}
+	}
+
+	start_urls := []string{url}
+	orgs := []string{opts.Args.TargetName}
+	if opts.Resource.Search || enterprise {
+		var logins []string
+		if enterprise {
+			logins, err = resolve_enterprise_orgs(ctx, opts.Args.TargetName)
+		} else {
+			logins, err = resolve_search_targets(ctx, opts.Args.TargetName, target_type)
+		}
+		if err != nil {
+			logger.Fatal(fmt.Sprintf("Could not list the orgs for %v. Error: %v", opts.Args.TargetName, err))
+		}
+		if len(logins) == 0 {
+			logger.Fatal(fmt.Sprintf("No orgs or users were found for %v", opts.Args.TargetName))
+		}
+		start_urls = start_urls[:0]
+		orgs = logins
+		for _, login := range logins {
+			start_urls = append(start_urls, github_repos_url(opts.Advanced.PathTemplate, target_type, login)+repo_query)
+			if owner_filter != nil {
+				owner_filter[strings.ToLower(login)] = true
+			}
+		}
+	}
+
+	if opts.Resource.MemberRepos {
+		members, err := resolve_org_members(ctx, orgs)
+		if err != nil {
+			logger.Fatal(fmt.Sprintf("Could not list the members of %v. Error: %v", strings.Join(orgs, ", "), err))
+		}
+		// The member listings use the API's default of the repos each user owns, --repo-type only applies to the orgs
+		for _, login := range members {
+			start_urls = append(start_urls, github_repos_url(opts.Advanced.PathTemplate, "users", login))
+			if owner_filter != nil {
+				owner_filter[strings.ToLower(login)] = true
+			}
+		}
+	}
+
+	var github_repo_data chan io.ReadCloser
+	if _, _, _, _, single_repo := single_repo_urls(url); target_type == "url" && single_repo {
+		github_repo_data = get_single_repo(ctx, url, target_type)
+	} else {
+		github_repo_data = get_repos_from_github(ctx, start_urls, target_type, opts.Advanced.SincePaging)
+	}
 
-	github_repo_data := get_repos_from_github(ctx, url)
+	repos := parse_github_response(ctx, github_repo_data, opts.Resource.ForkFilter, opts.Resource.NoMirrors, owner_filter, opts.Resource.MinStars, target_type, topic_filter, topic_exclude)
 
-	repos := parse_github_response(ctx, github_repo_data, opts.Resource.ForkFilter)
+	if opts.Resource.WithForks {
+		repos = expand_forks(ctx, repos, target_type)
+	}
+
+	if opts.Resource.WithWikis {
+		repos = expand_wikis(ctx, repos)
+	}
+
+	var over_budget uint32
+	if opts.Application.RamDiskSize > 0 {
+		repos = preflight_size_check(ctx, cancel, repos, opts.Application.RamDiskSize, size_filter, &over_budget)
+	}
 
-	local_repos := git_ops_clone(ctx, repos, &git_path, &working_dir, size_filter)
+	var directory_owners *DirectoryOwners
+	if opts.Application.ByDirectory > 0 {
+		directory_owners = &DirectoryOwners{owners: make(map[EmailGroupByRepoKey]map[string]uint64)}
+	}
+	var line_counts *LineCounts
+	if opts.Application.WithBlame {
+		line_counts = &LineCounts{lines: make(map[EmailGroupByRepoKey]uint64)}
+	}
+	var activity *ActivityHistogram
+	if len(activity_file) > 0 {
+		activity = &ActivityHistogram{hours: make(map[string]*[24]uint64), offsets: make(map[string]map[string]uint64), last: make(map[string]time.Time)}
+	}
+	var commit_counts *CommitCounts
+	// The report ranks the contributors too
+	if opts.Output.Top > 0 || len(report_file) > 0 {
+		commit_counts = &CommitCounts{commits: make(map[string]uint64)}
+	}
+	var contributors *RepoContributors
+	// The names come from the same shortlog lines as the per repo files
+	if len(per_repo_dir) > 0 || len(names_file) > 0 {
+		contributors = &RepoContributors{entries: make(map[EmailGroupByRepoKey]*FmtRepoContributor)}
+	}
+	var cloned *ClonedRepos
+	if len(no_identity_file) > 0 {
+		cloned = &ClonedRepos{repos: make(map[string]Repo)}
+	}
+	var pr_authors *PullAuthorProfiles
+	if opts.Application.PrAuthors {
+		pr_authors = &PullAuthorProfiles{profiles: make(map[string]ApiUser)}
+	}
+	var emails chan string
+	var contexts chan EmailContext
+	if opts.Application.GraphQL {
+		emails, contexts = graphql_commit_emails(ctx, repos, commit_counts, contributors, opts.Application.AuthorsOnly, pr_authors)
+	} else if opts.Application.NoClone {
+		emails, contexts = api_commit_emails(ctx, repos, target_type, commit_counts, contributors, opts.Application.AuthorsOnly, pr_authors)
+	} else {
+		// Only resolved once a stage needs it so the API only modes work without git installed
+		git_path, err = resolve_git_path(string(opts.Application.GitPath))
+		if err != nil {
+			logger.Fatal(err)
+		}
+		if !opts.Application.GitCreds && len(api_token()) > 0 {
+			if err = check_git_version(git_path); err != nil {
+				logger.Fatal(err)
+			}
+		}
+		local_repos := git_ops_clone(ctx, repos, &git_path, &working_dir, size_filter, opts.Application.MaxDisk, func() []string { return git_clone_env(target_type, opts.Application.GitCreds) }, clone_args, cloned, opts.Application.ReuseClones, opts.Application.DeepenThreshold)
+		emails, contexts = git_ops_shortlog(ctx, local_repos, &git_path, raw_shortlog_dir, line_counts, opts.Application.BlameMaxFiles, activity, opts.Application.IncludeTags, opts.Application.CleanupClones, opts.Application.PreserveOnError, commit_counts, contributors, exclude_paths, opts.Application.AuthorsOnly, directory_owners, opts.Application.ByDirectory, target_type, pr_authors)
+	}
 
-	emails, contexts := git_ops_shortlog(ctx, local_repos, &git_path)
+	emails_deduped, email_list_done := emails_dedup(emails, domain_allowlist, opts.Advanced.AggregateWorkers)
 
-	emails_deduped, email_list_done := emails_dedup(emails)
+	emails_grouped, email_group_done := emails_by_repo(contexts, domain_allowlist, opts.Advanced.AggregateWorkers)
 
-	emails_grouped, email_group_done := emails_by_repo(contexts)
+	// With --strict, the first error in any stage stops the pipeline and the partial results are written
+	var strict_aborted uint32
+	if opts.Application.Strict {
+		go func() {
+			ticker := time.NewTicker(250 * time.Millisecond)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					if stage_error_count() > 0 {
+						atomic.StoreUint32(&strict_aborted, 1)
+						logger.Error("Stopping on the first error because of --strict")
+						cancel()
+						return
+					}
+				}
+			}
+		}()
+	}
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
+	var interrupted uint32
 	go func() {
 		defer signal.Reset()
 		select {
 		case <-c:
+			atomic.StoreUint32(&interrupted, 1)
 			cancel()
 			return
 		case <-email_list_done:
@@ -1182,83 +6478,364 @@ func main() {
 	w := new(tabwriter.Writer)
 	w.Init(os.Stdout, 0, 4, 1, ' ', 0)
 
+	var status_sample *StatusSample
 selectloop:
 	for {
+		// A nil channel never fires, so a 0 interval leaves out the periodic status
+		var status_due <-chan time.Time
+		if opts.Application.StatusInterval > 0 {
+			status_due = time.After(opts.Application.StatusInterval)
+		}
 		select {
 		case <-email_list_done:
 			break selectloop
 		case <-email_group_done:
 			break selectloop
-		case <-time.After(10 * time.Second):
+		case <-status_due:
 			fmt.Println("=====START=====")
-			fmt.Fprintln(w, "Stage\tActive\tCompleted\tTotal\tErrors\t")
-			fmt.Fprintln(w, "Stage 1 - Get Github Repos\t", atomic.LoadUint32(&active_data[GITHUB_FETCH]), "\t", atomic.LoadUint32(&completion_data[GITHUB_FETCH]), "\t", atomic.LoadUint32(&total_data[GITHUB_TOTAL_PAGES]), "\t", atomic.LoadUint32(&error_data[GITHUB_FETCH]), "\t")
-			fmt.Fprintln(w, "Stage 2 - Parse URLs\t", atomic.LoadUint32(&active_data[GITHUB_PARSE]), "\t", atomic.LoadUint32(&completion_data[GITHUB_PARSE]), "\t", atomic.LoadUint32(&total_data[GITHUB_TOTAL_PAGES]), "\t", atomic.LoadUint32(&error_data[GITHUB_PARSE]), "\t")
-			fmt.Fprintln(w, "Stage 3 - Clone Repos\t", atomic.LoadUint32(&active_data[GIT_OPS_CLONE]), "\t", atomic.LoadUint32(&completion_data[GIT_OPS_CLONE]), "\t", atomic.LoadUint32(&total_data[REMOTE_REPOS]), "\t", atomic.LoadUint32(&error_data[GIT_OPS_CLONE]), "\t")
-			fmt.Fprintln(w, "Stage 4 - Find Emails\t", atomic.LoadUint32(&active_data[GIT_OPS_LOG]), "\t", atomic.LoadUint32(&completion_data[GIT_OPS_LOG]), "\t", atomic.LoadUint32(&total_data[LOCAL_REPOS]), "\t", atomic.LoadUint32(&error_data[GIT_OPS_LOG]), "\t")
-			fmt.Fprintln(w, "Stage 5a - Dedup Emails\t", "N/A", "\t", atomic.LoadUint32(&completion_data[EMAILS_DEDUP]), "\t", atomic.LoadUint32(&total_data[GIT_IDENTITIES]), "\t", "N/A", "\t")
-			fmt.Fprintln(w, "Stage 5b - Emails per Repo\t", "N/A", "\t", atomic.LoadUint32(&completion_data[EMAILS_GROUPED]), "\t", atomic.LoadUint32(&total_data[GIT_IDENTITIES]), "\t", "N/A", "\t")
-			w.Flush()
+			status_sample = write_status_table(w, status_sample)
 			fmt.Println("=====END=====")
 		}
 	}
 	<-email_list_done
 	<-email_group_done
 	cancel()
-	go func() {
-		fmt.Println("=====COMPLETED=====")
-		fmt.Fprintln(w, "Stage\tActive\tCompleted\tTotal\tErrors\t")
-		fmt.Fprintln(w, "Stage 1 - Get Github Repos\t", atomic.LoadUint32(&active_data[GITHUB_FETCH]), "\t", atomic.LoadUint32(&completion_data[GITHUB_FETCH]), "\t", atomic.LoadUint32(&total_data[GITHUB_TOTAL_PAGES]), "\t", atomic.LoadUint32(&error_data[GITHUB_FETCH]), "\t")
-		fmt.Fprintln(w, "Stage 2 - Parse URLs\t", atomic.LoadUint32(&active_data[GITHUB_PARSE]), "\t", atomic.LoadUint32(&completion_data[GITHUB_PARSE]), "\t", atomic.LoadUint32(&total_data[GITHUB_TOTAL_PAGES]), "\t", atomic.LoadUint32(&error_data[GITHUB_PARSE]), "\t")
-		fmt.Fprintln(w, "Stage 3 - Clone Repos\t", atomic.LoadUint32(&active_data[GIT_OPS_CLONE]), "\t", atomic.LoadUint32(&completion_data[GIT_OPS_CLONE]), "\t", atomic.LoadUint32(&total_data[REMOTE_REPOS]), "\t", atomic.LoadUint32(&error_data[GIT_OPS_CLONE]), "\t")
-		fmt.Fprintln(w, "Stage 4 - Find Emails\t", atomic.LoadUint32(&active_data[GIT_OPS_LOG]), "\t", atomic.LoadUint32(&completion_data[GIT_OPS_LOG]), "\t", atomic.LoadUint32(&total_data[LOCAL_REPOS]), "\t", atomic.LoadUint32(&error_data[GIT_OPS_LOG]), "\t")
-		fmt.Fprintln(w, "Stage 5a - Dedup Emails\t", "N/A", "\t", atomic.LoadUint32(&completion_data[EMAILS_DEDUP]), "\t", atomic.LoadUint32(&total_data[GIT_IDENTITIES]), "\t", "N/A", "\t")
-		fmt.Fprintln(w, "Stage 5b - Emails per Repo\t", "N/A", "\t", atomic.LoadUint32(&completion_data[EMAILS_GROUPED]), "\t", atomic.LoadUint32(&total_data[GIT_IDENTITIES]), "\t", "N/A", "\t")
-		w.Flush()
-		fmt.Println("=====COMPLETED=====")
-	}()
-	var out_files_wg sync.WaitGroup
-	defer out_files_wg.Wait()
-
-	out_files_wg.Add(1)
-	go func(output_file string, emails map[string]uint) {
-		defer out_files_wg.Done()
-		if len(emails) == 0 {
-			// Nothing to write
-			return
-		}
-		err := create_output_file(output_file, emails)
-		if err != nil {
-			logger.Error("There was an error: ", err)
-			return
+	if known_domains != nil {
+		found := new_domains(emails_grouped, known_domains)
+		names := make([]string, 0, len(found))
+		for _, entry := range found {
+			names = append(names, entry.Domain)
 		}
-		// Sleep for a little to ensure this prints at the end (dirty and if someone can help that would be ideal)
-		time.Sleep(250 * time.Millisecond)
-		logger.Info("Successfully wrote the file", output_file)
-	}(output_file, emails_deduped)
+		logger.Info("Found ", len(found), " domains that aren't in ", opts.Output.KnownDomains, ": ", strings.Join(names, ", "))
+	}
 
-	out_files_wg.Add(1)
-	go func(output_json string, emails_grouped map[EmailGroupByRepoKey]int8) {
-		defer out_files_wg.Done()
-		if len(emails_grouped) == 0 {
-			// Nothing to write
-			return
+	var domain_info map[string]FmtDomainInfo
+	if opts.Output.ValidateDomains {
+		domains := []string{}
+		for domain := range emails_grouped.EmailsByDomain() {
+			if domain != "!none!" {
+				domains = append(domains, domain)
+			}
 		}
-		err := create_output_json(output_json, emails_grouped)
-		if err != nil {
-			logger.Error("There was an error: ", err)
-			return
+		// The pipeline context is already cancelled by now
+		validate_ctx, validate_cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+		domain_info = validate_domains(validate_ctx, domains)
+		validate_cancel()
+	}
+
+	var out_files_wg sync.WaitGroup
+
+	if len(output_file) > 0 {
+		out_files_wg.Add(1)
+		go func(output_file string, emails *EmailSet) {
+			defer out_files_wg.Done()
+			if emails.Len() == 0 {
+				// Nothing to write
+				return
+			}
+			err := create_output_file(output_file, emails, false)
+			if err != nil {
+				logger.Error("There was an error: ", err)
+				return
+			}
+			logger.Info("Successfully wrote the file", output_file)
+		}(output_file, emails_deduped)
+	}
+
+	if len(emails_only_file) > 0 {
+		out_files_wg.Add(1)
+		go func(emails_only_file string, emails *EmailSet) {
+			defer out_files_wg.Done()
+			if emails.Len() == 0 {
+				// Nothing to write
+				return
+			}
+			err := create_output_file(emails_only_file, emails, true)
+			if err != nil {
+				logger.Error("There was an error: ", err)
+				return
+			}
+			logger.Info("Successfully wrote the emails only file", emails_only_file)
+		}(emails_only_file, emails_deduped)
+	}
+
+	if len(names_file) > 0 {
+		out_files_wg.Add(1)
+		go func(names_file string, contributors *RepoContributors) {
+			defer out_files_wg.Done()
+			names := contributors.Names(domain_allowlist)
+			if len(names) == 0 {
+				// Nothing to write
+				return
+			}
+			err := create_names_file(names_file, names)
+			if err != nil {
+				logger.Error("There was an error: ", err)
+				return
+			}
+			logger.Info("Successfully wrote the names file", names_file)
+		}(names_file, contributors)
+	}
+
+	if len(per_repo_dir) > 0 {
+		out_files_wg.Add(1)
+		go func(per_repo_dir string, emails_grouped *EmailGroups) {
+			defer out_files_wg.Done()
+			count, err := create_per_repo_files(per_repo_dir, ".csv"+output_extension, emails_grouped, contributors, opts.Output.Roles == "combined")
+			if err != nil {
+				logger.Error("There was an error: ", err)
+				return
+			}
+			logger.Info("Successfully wrote ", count, " per repo files to ", per_repo_dir)
+		}(per_repo_dir, emails_grouped)
+	}
+
+	if len(report_file) > 0 {
+		out_files_wg.Add(1)
+		go func(report_file string, emails_grouped *EmailGroups) {
+			defer out_files_wg.Done()
+			err := create_report_file(report_file, opts.Args.TargetName, emails_grouped, commit_counts.Top(REPORT_TOP, domain_allowlist))
+			if err != nil {
+				logger.Error("There was an error: ", err)
+				return
+			}
+			logger.Info("Successfully wrote the report file", report_file)
+		}(report_file, emails_grouped)
+	}
+
+	meta := FmtMeta{Version: VERSION, Target: opts.Args.TargetName, TargetType: target_type, Started: start_time, Options: options_meta(opts.Resource, opts.Output, opts.Application, opts.Advanced)}
+	var json_data map[string]interface{}
+	if len(output_json) > 0 || len(combined_file) > 0 {
+		if len(target_domains) == 0 {
+			if domain := infer_target_domain(emails_grouped); len(domain) > 0 {
+				logger.Info("No --target-domains given, taking the most common domain ", domain, " as the target's")
+				target_domains = map[string]bool{domain: true}
+			}
 		}
-		// Sleep for a little to ensure this prints at the end (dirty and if someone can help that would be ideal)
-		time.Sleep(250 * time.Millisecond)
-		logger.Info("Successfully wrote the json", output_json)
-	}(output_json, emails_grouped)
+		// Built once for both the --json and the --combined
+		json_data = output_json_data(emails_grouped, opts.Output.NestByOwner, opts.Output.WidespreadMin, line_counts, opts.Output.Roles == "combined", domain_info, known_domains, opts.Output.WithVisibility, g_renames.Names(), directory_owners, target_domains, meta)
+	}
+	if len(output_json) > 0 {
+		out_files_wg.Add(1)
+		go func(output_json string, json_data map[string]interface{}) {
+			defer out_files_wg.Done()
+			// Written even when empty (e.g. interrupted early) so the file is always valid JSON
+			err := create_output_json(output_json, json_data)
+			if err != nil {
+				logger.Error("There was an error: ", err)
+				return
+			}
+			logger.Info("Successfully wrote the json", output_json)
+		}(output_json, json_data)
+	}
+
+	if len(combined_file) > 0 {
+		out_files_wg.Add(1)
+		go func(combined_file string, emails *EmailSet, json_data map[string]interface{}) {
+			defer out_files_wg.Done()
+			// Like the --json it is written even when empty
+			err := create_combined_file(combined_file, emails, json_data)
+			if err != nil {
+				logger.Error("There was an error: ", err)
+				return
+			}
+			logger.Info("Successfully wrote the combined file", combined_file)
+		}(combined_file, emails_deduped, json_data)
+	}
+
+	if len(widespread_file) > 0 {
+		out_files_wg.Add(1)
+		go func(widespread_file string, emails_grouped *EmailGroups) {
+			defer out_files_wg.Done()
+			if emails_grouped.Len() == 0 {
+				// Nothing to write
+				return
+			}
+			err := create_widespread_file(widespread_file, widespread_emails(emails_grouped, opts.Output.WidespreadMin))
+			if err != nil {
+				logger.Error("There was an error: ", err)
+				return
+			}
+			logger.Info("Successfully wrote the widespread file", widespread_file)
+		}(widespread_file, emails_grouped)
+	}
+
+	if len(graph_file) > 0 {
+		out_files_wg.Add(1)
+		go func(graph_file string, emails_grouped *EmailGroups) {
+			defer out_files_wg.Done()
+			if emails_grouped.Len() == 0 {
+				// Nothing to write
+				return
+			}
+			err := create_graph_file(graph_file, emails_grouped, opts.Output.GraphFormat, opts.Output.Roles == "combined")
+			if err != nil {
+				logger.Error("There was an error: ", err)
+				return
+			}
+			logger.Info("Successfully wrote the graph", graph_file)
+		}(graph_file, emails_grouped)
+	}
+
+	if len(diff_file) > 0 {
+		out_files_wg.Add(1)
+		go func(diff_file string, emails_grouped *EmailGroups) {
+			defer out_files_wg.Done()
+			// Written even when nothing was found so everything in the baseline shows up as removed
+			err := create_baseline_diff(diff_file, emails_grouped, baseline)
+			if err != nil {
+				logger.Error("There was an error: ", err)
+				return
+			}
+			logger.Info("Successfully wrote the baseline diff", diff_file)
+		}(diff_file, emails_grouped)
+	}
+
+	if len(activity_file) > 0 {
+		out_files_wg.Add(1)
+		go func(activity_file string) {
+			defer out_files_wg.Done()
+			err := create_activity_file(activity_file, activity, domain_allowlist)
+			if err != nil {
+				logger.Error("There was an error: ", err)
+				return
+			}
+			logger.Info("Successfully wrote the activity file", activity_file)
+		}(activity_file)
+	}
+
+	if len(no_identity_file) > 0 {
+		// Always written so an empty list confirms every cloned repo had emails
+		out_files_wg.Add(1)
+		go func(no_identity_file string) {
+			defer out_files_wg.Done()
+			repos := no_identity_repos(cloned, emails_grouped)
+			if len(repos) > 0 {
+				logger.Info(len(repos), " cloned repos had no emails")
+			}
+			err := create_no_identity_file(no_identity_file, repos)
+			if err != nil {
+				logger.Error("There was an error: ", err)
+				return
+			}
+			logger.Info("Successfully wrote the no identity repos file", no_identity_file)
+		}(no_identity_file)
+	}
+
+	if len(errors_file) > 0 {
+		// Always written so an empty list confirms nothing failed
+		out_files_wg.Add(1)
+		go func(errors_file string) {
+			defer out_files_wg.Done()
+			err := create_errors_file(errors_file, g_failures.Records())
+			if err != nil {
+				logger.Error("There was an error: ", err)
+				return
+			}
+			logger.Info("Successfully wrote the errors file", errors_file)
+		}(errors_file)
+	}
+
+	if len(trace_file) > 0 {
+		out_files_wg.Add(1)
+		go func(trace_file string) {
+			defer out_files_wg.Done()
+			err := create_trace_file(trace_file, build_trace(start_time, g_trace.Spans()))
+			if err != nil {
+				logger.Error("There was an error: ", err)
+				return
+			}
+			logger.Info("Successfully wrote the trace file", trace_file)
+		}(trace_file)
+	}
+
+	if len(fetch_log_file) > 0 {
+		out_files_wg.Add(1)
+		go func(fetch_log_file string) {
+			defer out_files_wg.Done()
+			err := create_fetch_log_file(fetch_log_file, g_fetch_log.Records())
+			if err != nil {
+				logger.Error("There was an error: ", err)
+				return
+			}
+			logger.Info("Successfully wrote the fetch log", fetch_log_file)
+		}(fetch_log_file)
+	}
+
+	out_files_wg.Wait()
+	email_count := emails_deduped.Len()
+	if email_count == 0 && atomic.LoadUint32(&strict_aborted) == 0 && atomic.LoadUint32(&interrupted) == 0 && atomic.LoadUint32(&over_budget) == 0 {
+		report_empty_harvest()
+	}
+	if removed := remove_empty_placeholders(); removed > 0 {
+		logger.Info("Removed ", removed, " output files that had nothing to write")
+	}
+	var counts FmtCounts
+	if opts.Output.CountOnly {
+		// Taken before the groups are closed
+		counts = harvest_counts(emails_grouped, email_count)
+	}
+	// Closed before the working_dir goes since the spill files live there
+	emails_deduped.Close()
+	emails_grouped.Close()
 
-	if !opts.Application.PreserveDir {
+	if opts.Application.PreserveOnError && !opts.Application.PreserveDir && stage_error_count() > 0 {
+		logger.Info("Keeping the working_dir ", working_dir, " for inspection since there were errors")
+	} else if !opts.Application.PreserveDir {
 		logger.Info("Clearing working_dir")
 		err = os.RemoveAll(working_dir)
 		if err != nil {
 			logger.Panic(fmt.Sprintf("Could not clear %v. Error: %v", working_dir, err))
 		}
 	}
+
+	// Flush the log lines from the writers so the summary is always the last thing printed
+	logger.Wait()
+	fmt.Println("=====COMPLETED=====")
+	write_status_table(w, nil)
+	fmt.Println("=====COMPLETED=====")
+	// Printed even with --quiet, it is the only output
+	if opts.Output.CountOnly {
+		fmt.Println("=====COUNTS=====")
+		write_counts_table(w, counts)
+		fmt.Println("=====END=====")
+	}
+	if opts.Output.Top > 0 && !opts.Application.Quiet {
+		fmt.Println("=====TOP CONTRIBUTORS=====")
+		write_top_table(w, commit_counts.Top(opts.Output.Top, domain_allowlist))
+		fmt.Println("=====END=====")
+	}
+
+	exit_code := EXIT_OK
+	if atomic.LoadUint32(&over_budget) == 1 {
+		exit_code = EXIT_FATAL
+	} else if atomic.LoadUint32(&strict_aborted) == 1 {
+		exit_code = EXIT_STRICT_ABORT
+	} else if error_count := stage_error_count(); error_count > 0 {
+		logger.Error("Completed with ", error_count, " errors across the stages")
+		exit_code = EXIT_STAGE_ERRORS
+	}
+	if len(opts.Advanced.WebhookUrl) > 0 {
+		summary := WebhookSummary{
+			Target:          opts.Args.TargetName,
+			TargetType:      target_type,
+			Repos:           atomic.LoadUint32(&completion_data[GIT_OPS_CLONE]),
+			Emails:          email_count,
+			Identities:      atomic.LoadUint32(&total_data[GIT_IDENTITIES]),
+			DurationSeconds: time.Since(start_time).Seconds(),
+			ErrorCount:      stage_error_count(),
+			ExitCode:        exit_code,
+		}
+		if err := send_webhook(opts.Advanced.WebhookUrl, summary); err != nil {
+			logger.Error("Could not deliver the webhook. Error: ", err)
+		} else {
+			logger.Info("Delivered the webhook to ", opts.Advanced.WebhookUrl)
+		}
+	}
+	if exit_code != EXIT_OK {
+		// os.Exit skips the deferred functions
+		cancel()
+		logger.Wait()
+		os.Exit(exit_code)
+	}
 }
@@ -0,0 +1,565 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+	"golang.org/x/time/rate"
+)
+
+func TestMain(m *testing.M) {
+	g_buff_pool = sync.Pool{
+		New: func() interface{} {
+			return new(bytes.Buffer)
+		},
+	}
+	// Only the fatal errors, the stages log plenty on the failures the tests set up
+	logger.set_level(LOG_FATAL)
+	os.Exit(m.Run())
+}
+
+// The globals main sets up before the API stages run
+func setup_fetch(retries int) {
+	g_semaphore = semaphore.NewWeighted(4)
+	g_live_work = semaphore.NewWeighted(4)
+	g_api_limiter = rate.NewLimiter(rate.Inf, 0)
+	g_http_client = &http.Client{Timeout: 5 * time.Second}
+	BUFFER_SIZE = 10
+	PAGE_BUFFER_SIZE = 10
+	REPO_BUFFER_SIZE = 10
+	FETCH_RETRIES = retries
+	FETCH_BACKOFF = 0
+	API_TOKEN = ""
+	completion_data = make([]uint32, 6)
+	error_data = make([]uint32, 6)
+	total_data = make([]uint32, 4)
+	active_data = make([]uint32, 4)
+}
+
+// Reads every page the fetch stage hands on
+func drain_pages(t *testing.T, pages chan io.ReadCloser) []string {
+	var bodies []string
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case body, ok := <-pages:
+			if !ok {
+				return bodies
+			}
+			data, _ := ioutil.ReadAll(body)
+			bodies = append(bodies, string(data))
+		case <-timeout:
+			t.Fatal("the fetch stage never finished")
+		}
+	}
+}
+
+func TestCheckTypeOptions(t *testing.T) {
+	tests := []struct {
+		name     string
+		resource ResourceOptions
+		err      string
+	}{
+		{"user", ResourceOptions{User: true}, ""},
+		{"org", ResourceOptions{Org: true}, ""},
+		{"url", ResourceOptions{Url: true}, ""},
+		{"type", ResourceOptions{Type: "gitlab"}, ""},
+		{"none", ResourceOptions{}, "Please provide either org, user or url"},
+		{"user and org", ResourceOptions{User: true, Org: true}, "Got: --user, --org"},
+		// Three set passes a chained != parity check
+		{"user, org and url", ResourceOptions{User: true, Org: true, Url: true}, "Got: --user, --org, --url"},
+		{"org and type", ResourceOptions{Org: true, Type: "org"}, "Got: --org, --type org"},
+		{"all", ResourceOptions{User: true, Org: true, Url: true, Type: "user"}, "Got: --user, --org, --url, --type user"},
+	}
+	for _, test := range tests {
+		err := check_type_options(test.resource)
+		if len(test.err) == 0 {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", test.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got error %v, want one containing %q", test.name, err, test.err)
+		}
+	}
+}
+
+func TestNormalizeDomain(t *testing.T) {
+	tests := []struct {
+		domain string
+		want   string
+	}{
+		{"example.com", "example.com"},
+		{"Example.COM", "example.com"},
+		{"m\u00fcnchen.de", "xn--mnchen-3ya.de"},
+		{"xn--mnchen-3ya.de", "xn--mnchen-3ya.de"},
+		{"XN--MNCHEN-3YA.DE", "xn--mnchen-3ya.de"},
+		{"b\u00fccher.example", "xn--bcher-kva.example"},
+		{"\u4f8b\u3048.\u30c6\u30b9\u30c8", "xn--r8jz45g.xn--zckzah"},
+		// A decomposed u and combining diaeresis is the same label as the precomposed one
+		{"mu\u0308nchen.de", "xn--mnchen-3ya.de"},
+		{"M\u00dcNCHEN.DE", "xn--mnchen-3ya.de"},
+		// Rejected by IDNA, only lower cased
+		{"Under_Score.Example", "under_score.example"},
+	}
+	for _, test := range tests {
+		if got := normalize_domain(test.domain); got != test.want {
+			t.Errorf("normalize_domain(%q) = %q, want %q", test.domain, got, test.want)
+		}
+	}
+}
+
+func TestOutputJsonFoldsDomainCase(t *testing.T) {
+	repo_a := &Repo{Name: "a", Clone_url: "https://github.com/corp/a.git"}
+	repo_b := &Repo{Name: "b", Clone_url: "https://github.com/corp/b.git"}
+	emails_grouped := &EmailGroups{grouped: make(map[EmailGroupByRepoKey]int8)}
+	emails_grouped.add(EmailGroupByRepoKey{Email: "dev@Corp.com", Repo: repo_a}, ROLE_AUTHOR)
+	emails_grouped.add(EmailGroupByRepoKey{Email: "ops@corp.com", Repo: repo_b}, ROLE_AUTHOR)
+	emails_grouped.add(EmailGroupByRepoKey{Email: "it@CORP.COM", Repo: repo_a}, ROLE_COMMITTER)
+	emails_grouped.add(EmailGroupByRepoKey{Email: "dev@M\u00fcnchen.de", Repo: repo_b}, ROLE_AUTHOR)
+	output := output_json_data(emails_grouped, false, 0, nil, false, nil, nil, false, nil, nil, map[string]bool{"corp.com": true}, FmtMeta{})
+
+	emails := output["emails"].(map[string]map[string][]FmtRepoPerEmail)
+	if len(emails) != 2 {
+		t.Errorf("got the domains %v, want corp.com and xn--mnchen-3ya.de", emails)
+	}
+	if corp := emails["corp.com"]; len(corp) != 3 || len(corp["dev@Corp.com"]) != 1 || len(corp["ops@corp.com"]) != 1 || len(corp["it@CORP.COM"]) != 1 {
+		t.Errorf("got %v under corp.com, want the three emails as found", corp)
+	}
+	if len(emails["xn--mnchen-3ya.de"]) != 1 {
+		t.Errorf("got %v under xn--mnchen-3ya.de, want dev@M\u00fcnchen.de", emails["xn--mnchen-3ya.de"])
+	}
+	// The smallest spelling is the sample, so it doesn't change between runs
+	casing := output["domain_casing"].(map[string]string)
+	if casing["corp.com"] != "CORP.COM" || casing["xn--mnchen-3ya.de"] != "M\u00fcnchen.de" || len(casing) != 2 {
+		t.Errorf("got domain_casing %v", casing)
+	}
+	internal := output["internal"].(map[string]bool)
+	for _, email := range []string{"dev@Corp.com", "ops@corp.com", "it@CORP.COM"} {
+		if !internal[email] {
+			t.Errorf("%s is not internal to corp.com", email)
+		}
+	}
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	plaintext := []byte(`{"emails":{"dev@example.com":{}}}`)
+	sealed, err := encrypt_data("hunter2", plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(sealed, []byte(ENCRYPTION_MAGIC)) || bytes.Contains(sealed, plaintext) {
+		t.Fatalf("sealed output is not an encrypted file")
+	}
+	opened, err := decrypt_data("hunter2", sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(opened, plaintext) {
+		t.Errorf("decrypt_data = %q, want %q", opened, plaintext)
+	}
+}
+
+func TestDecryptTampered(t *testing.T) {
+	sealed, err := encrypt_data("hunter2", []byte("dev@example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	iterations_at := len(ENCRYPTION_MAGIC)
+	set_iterations := func(iterations uint32) func([]byte) []byte {
+		return func(data []byte) []byte {
+			binary.BigEndian.PutUint32(data[iterations_at:], iterations)
+			return data
+		}
+	}
+	tests := []struct {
+		name       string
+		passphrase string
+		tamper     func([]byte) []byte
+	}{
+		{"wrong passphrase", "hunter3", func(data []byte) []byte { return data }},
+		{"flipped ciphertext", "hunter2", func(data []byte) []byte { data[len(data)-1] ^= 1; return data }},
+		{"flipped salt", "hunter2", func(data []byte) []byte { data[iterations_at+4] ^= 1; return data }},
+		{"lowered iterations", "hunter2", set_iterations(ENCRYPTION_ITERATIONS - 1)},
+		{"zero iterations", "hunter2", set_iterations(0)},
+		{"huge iterations", "hunter2", set_iterations(^uint32(0))},
+		{"truncated", "hunter2", func(data []byte) []byte { return data[:iterations_at+4+ENCRYPTION_SALT_SIZE+2] }},
+		{"bad magic", "hunter2", func(data []byte) []byte { data[0] = 'X'; return data }},
+	}
+	for _, test := range tests {
+		data := test.tamper(append([]byte(nil), sealed...))
+		if _, err := decrypt_data(test.passphrase, data); err == nil {
+			t.Errorf("%s: decrypt_data succeeded", test.name)
+		}
+	}
+}
+
+func TestParseShortlogEmail(t *testing.T) {
+	tests := []struct {
+		line  string
+		email string
+		ok    bool
+	}{
+		{"    12\tJane Doe <jane@example.com>", "jane@example.com", true},
+		{"     1\tJane <Doe> <jane@example.com>\r", "jane@example.com", true},
+		// An empty email is still an identity, it is grouped as !blank!
+		{"     3\tJane Doe <>", "", true},
+		{"     3\t<>", "", true},
+		// Name only lines have nothing to count
+		{"     5\tJane Doe", "", false},
+		{"     5\tJane Doe <jane@example.com", "", false},
+		{"     5\tJane Doe jane@example.com>", "", false},
+		{"", "", false},
+	}
+	for _, test := range tests {
+		email, ok := parse_shortlog_email(test.line)
+		if email != test.email || ok != test.ok {
+			t.Errorf("parse_shortlog_email(%q) = %q, %v, want %q, %v", test.line, email, ok, test.email, test.ok)
+		}
+	}
+}
+
+func TestParseGitVersion(t *testing.T) {
+	tests := []struct {
+		output string
+		major  int
+		minor  int
+		ok     bool
+	}{
+		{"git version 2.39.5\n", 2, 39, true},
+		{"git version 2.31.0", 2, 31, true},
+		{"git version 2.30.9.windows.1\r\n", 2, 30, true},
+		{"git version 2.37.1 (Apple Git-137.1)", 2, 37, true},
+		{"git version 1.8.3.1", 1, 8, true},
+		{"git version 3", 0, 0, false},
+		{"hub version 2.14.2", 0, 0, false},
+		{"", 0, 0, false},
+	}
+	for _, test := range tests {
+		major, minor, err := parse_git_version(test.output)
+		if (err == nil) != test.ok || major != test.major || minor != test.minor {
+			t.Errorf("parse_git_version(%q) = %d, %d, %v, want %d, %d, ok %v", test.output, major, minor, err, test.major, test.minor, test.ok)
+		}
+	}
+}
+
+func TestGitCloneArgsDefaultDepth(t *testing.T) {
+	tests := []struct {
+		extra_args    string
+		default_depth int
+		want          string
+	}{
+		{"", 0, "clone -n -q --filter=tree:0"},
+		{"", 100, "clone -n -q --filter=tree:0 --depth=100"},
+		{"--depth=1", 100, "clone -n -q --filter=tree:0 --depth=1"},
+		{"--shallow-since=2020-01-01", 100, "clone -n -q --filter=tree:0 --shallow-since=2020-01-01"},
+		{"--single-branch", 100, "clone -n -q --filter=tree:0 --depth=100 --single-branch"},
+	}
+	for _, test := range tests {
+		args, err := git_clone_args(test.extra_args, false, test.default_depth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(args, " "); got != test.want {
+			t.Errorf("git_clone_args(%q, false, %d) = %q, want %q", test.extra_args, test.default_depth, got, test.want)
+		}
+	}
+}
+
+func TestParseLinkHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+		next   string
+		last   string
+	}{
+		{"github order", []string{`<https://api.github.com/orgs/x/repos?page=2>; rel="next", <https://api.github.com/orgs/x/repos?page=5>; rel="last"`}, "https://api.github.com/orgs/x/repos?page=2", "https://api.github.com/orgs/x/repos?page=5"},
+		{"reordered rels", []string{`<https://h/r?page=1>; rel="first", <https://h/r?page=5>; rel="last", <https://h/r?page=3>; rel="next", <https://h/r?page=1>; rel="prev"`}, "https://h/r?page=3", "https://h/r?page=5"},
+		{"next last", []string{`<https://h/r?page=2>; rel="next last"`}, "https://h/r?page=2", "https://h/r?page=2"},
+		{"extra params", []string{`<https://h/r?page=2>; type="application/json"; rel="next"; title="Next page", <https://h/r?page=4>; title="Last"; rel=last`}, "https://h/r?page=2", "https://h/r?page=4"},
+		{"odd whitespace", []string{"  < https://h/r?page=2 >\t;rel = \"next\" ,\n<https://h/r?page=9>;  REL=\"Last\"  "}, "https://h/r?page=2", "https://h/r?page=9"},
+		{"split headers", []string{`<https://h/r?page=9>; rel="last"`, `<https://h/r?page=2>; rel="next"`}, "https://h/r?page=2", "https://h/r?page=9"},
+		{"no next", []string{`<https://h/r?page=1>; rel="first", <https://h/r?page=4>; rel="prev"`}, "", ""},
+		{"no header", nil, "", ""},
+	}
+	for _, test := range tests {
+		header := map[string][]string{}
+		if test.values != nil {
+			header["Link"] = test.values
+		}
+		links := parse_link_header(header)
+		if links["next"] != test.next || links["last"] != test.last {
+			t.Errorf("%s: next %q, last %q, want %q, %q", test.name, links["next"], links["last"], test.next, test.last)
+		}
+		var next_url string
+		if ok := get_next_link(header, &next_url); ok != (len(test.next) > 0) || next_url != test.next {
+			t.Errorf("%s: get_next_link = %v, %q, want %q", test.name, ok, next_url, test.next)
+		}
+	}
+}
+
+func TestDecodeRepos(t *testing.T) {
+	tests := []struct {
+		name        string
+		target_type string
+		body        string
+		want        []Repo
+		not_found   bool
+		err         bool
+	}{
+		{"github array", "orgs", `[{"name":"a","clone_url":"https://github.com/x/a.git","size":12,"fork":true,"owner":{"login":"x"}}]`,
+			[]Repo{{Name: "a", Clone_url: "https://github.com/x/a.git", Size: 12, Fork: true, Owner: RepoOwner{Login: "x"}}}, false, false},
+		{"github empty page", "users", ` []`, []Repo{}, false, false},
+		{"github 404", "orgs", `{"message":"Not Found","documentation_url":"https://docs.github.com/rest"}`, nil, true, true},
+		{"github rate limit", "orgs", `{"message":"API rate limit exceeded for 1.2.3.4."}`, nil, false, true},
+		{"github other object", "orgs", `{"total_count":1}`, nil, false, true},
+		{"gitlab array", "gitlab", `[{"id":7,"path_with_namespace":"g/sub/p","http_url_to_repo":"https://gitlab.com/g/sub/p.git","star_count":3,"visibility":"private","forked_from_project":{"id":1},"namespace":{"full_path":"g/sub"}}]`,
+			[]Repo{{Id: 7, Name: "g/sub/p", Clone_url: "https://gitlab.com/g/sub/p.git", Stargazers_count: 3, Private: true, Fork: true, Owner: RepoOwner{Login: "g/sub"}}}, false, false},
+		{"gitlab 404", "gitlab", `{"message":"404 Group Not Found"}`, nil, true, true},
+		{"azure wrapper", "azure-devops", `{"count":1,"value":[{"name":"r","remoteUrl":"https://dev.azure.com/o/p/_git/r","size":4096,"isFork":false}]}`,
+			[]Repo{{Name: "r", Clone_url: "https://dev.azure.com/o/p/_git/r", Size: 4}}, false, false},
+		{"azure error", "azure-devops", `{"$id":"1","message":"TF400813: The user is not authorized to access this resource."}`, nil, false, true},
+	}
+	for _, test := range tests {
+		repos, err := decode_repos(json.NewDecoder(strings.NewReader(test.body)), test.target_type)
+		if (err != nil) != test.err {
+			t.Errorf("%s: error %v, want error %v", test.name, err, test.err)
+			continue
+		}
+		var not_found bool
+		if api_err, ok := err.(*ApiError); ok {
+			not_found = api_err.NotFound()
+		}
+		if not_found != test.not_found {
+			t.Errorf("%s: error %#v, want a not found ApiError %v", test.name, err, test.not_found)
+		}
+		if test.err {
+			continue
+		}
+		if len(repos) != len(test.want) {
+			t.Errorf("%s: got %d repos, want %d", test.name, len(repos), len(test.want))
+			continue
+		}
+		for index := range repos {
+			got, want := repos[index], test.want[index]
+			if got.Id != want.Id || got.Name != want.Name || got.Clone_url != want.Clone_url || got.Size != want.Size || got.Fork != want.Fork || got.Private != want.Private || got.Owner != want.Owner || got.Stargazers_count != want.Stargazers_count {
+				t.Errorf("%s: got %+v, want %+v", test.name, got, want)
+			}
+		}
+	}
+}
+
+func TestFetchRetriesServerErrors(t *testing.T) {
+	for _, retries := range []int{0, 1, 3} {
+		var hits uint32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddUint32(&hits, 1)
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte(`{"message":"Server Error"}`))
+		}))
+		setup_fetch(retries)
+		pages := drain_pages(t, get_repos_from_github(context.Background(), []string{server.URL + "/orgs/x/repos"}, "orgs", false))
+		server.Close()
+		if len(pages) != 0 {
+			t.Errorf("retries %d: got pages %q from a failing server", retries, pages)
+		}
+		if got := atomic.LoadUint32(&hits); got != uint32(retries+1) {
+			t.Errorf("retries %d: the server was hit %d times, want %d", retries, got, retries+1)
+		}
+	}
+}
+
+func TestFetchRetriesRecover(t *testing.T) {
+	var hits uint32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddUint32(&hits, 1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`[{"name":"a"}]`))
+	}))
+	defer server.Close()
+	setup_fetch(3)
+	pages := drain_pages(t, get_repos_from_github(context.Background(), []string{server.URL + "/orgs/x/repos"}, "orgs", false))
+	if len(pages) != 1 || pages[0] != `[{"name":"a"}]` {
+		t.Errorf("got pages %q, want the one after the retries", pages)
+	}
+	if got := atomic.LoadUint32(&hits); got != 3 {
+		t.Errorf("the server was hit %d times, want 3", got)
+	}
+}
+
+func TestFetchFollowsRename(t *testing.T) {
+	var old_hits uint32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/orgs/old-name/repos":
+			atomic.AddUint32(&old_hits, 1)
+			http.Redirect(w, r, "/organizations/42/repos?"+r.URL.RawQuery, http.StatusMovedPermanently)
+		case "/organizations/42/repos":
+			if r.URL.Query().Get("page") == "2" {
+				w.Write([]byte(`[{"name":"b"}]`))
+				return
+			}
+			w.Header().Set("Link", `</organizations/42/repos?per_page=1&page=2>; rel="next", </organizations/42/repos?per_page=1&page=2>; rel="last"`)
+			w.Write([]byte(`[{"name":"a"}]`))
+		case "/organizations/42":
+			w.Write([]byte(`{"login":"New-Name","id":42}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	setup_fetch(0)
+	g_renames = TargetRenames{names: make(map[string]string)}
+	pages := drain_pages(t, get_repos_from_github(context.Background(), []string{server.URL + "/orgs/old-name/repos?per_page=1"}, "orgs", false))
+	if len(pages) != 2 || pages[0] != `[{"name":"a"}]` || pages[1] != `[{"name":"b"}]` {
+		t.Errorf("got pages %q, want both pages of the new location", pages)
+	}
+	// The next page is asked for at the new location, not through the redirect again
+	if got := atomic.LoadUint32(&old_hits); got != 1 {
+		t.Errorf("the old path was hit %d times, want 1", got)
+	}
+	if names := g_renames.Names(); len(names) != 1 || names["old-name"] != "New-Name" {
+		t.Errorf("got renames %v, want old-name renamed to New-Name", names)
+	}
+	if !g_renames.RenamedTo("new-name") {
+		t.Errorf("RenamedTo(new-name) = false for the new name")
+	}
+}
+
+func TestWriteFileAtomicKeepsOldFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "repoharvester")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	output_path := filepath.Join(dir, "out.json")
+	if err := write_file_atomic(output_path, func(file io.Writer) error {
+		_, err := file.Write([]byte(`{"emails":{}}`))
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// Stopped halfway through the second write, like an interrupt during the output
+	err = write_file_atomic(output_path, func(file io.Writer) error {
+		file.Write([]byte(`{"emails":{"example.com":`))
+		return context.Canceled
+	})
+	if err != context.Canceled {
+		t.Errorf("write_file_atomic = %v, want the error of the write", err)
+	}
+	data, err := ioutil.ReadFile(output_path)
+	if err != nil || string(data) != `{"emails":{}}` {
+		t.Errorf("got %q, %v, want the complete first write", data, err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("got %d files, want the temp file removed", len(files))
+	}
+}
+
+func TestInterruptedJsonIsValid(t *testing.T) {
+	setup_fetch(0)
+	dir, err := ioutil.TempDir("", "repoharvester")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	repos := make([]*Repo, 10)
+	for index := range repos {
+		repos[index] = &Repo{Name: fmt.Sprintf("repo%d", index), Clone_url: fmt.Sprintf("https://github.com/x/repo%d.git", index), Owner: RepoOwner{Login: "x"}}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Keeps sending like the shortlog stage until it is cancelled, then closes its output the same way
+	contexts := make(chan EmailContext, 10)
+	go func() {
+		defer close(contexts)
+		for index := 0; ; index++ {
+			select {
+			case <-ctx.Done():
+				return
+			case contexts <- EmailContext{Repo: repos[index%len(repos)], EmailAddress: fmt.Sprintf("dev%d@example.com", index%5000), Role: ROLE_AUTHOR}:
+			}
+		}
+	}()
+	emails_grouped, done := emails_by_repo(contexts, nil, 4)
+	for atomic.LoadUint32(&completion_data[EMAILS_GROUPED]) < 1000 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the grouping never finished after the cancel")
+	}
+	output_json := filepath.Join(dir, "out.json")
+	json_data := output_json_data(emails_grouped, false, 0, nil, false, nil, nil, false, nil, nil, nil, FmtMeta{})
+	if err := create_output_json(output_json, json_data); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(output_json)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !json.Valid(data) {
+		t.Fatalf("the partial JSON is not valid")
+	}
+	baseline, err := load_baseline(output_json, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	grouped_emails := make(map[string]bool)
+	emails_grouped.ForEach(func(key EmailGroupByRepoKey, role int8) {
+		grouped_emails[key.Email] = true
+	})
+	if len(baseline.Emails) == 0 || len(baseline.Emails) != len(grouped_emails) {
+		t.Errorf("the JSON has %d emails, want the %d grouped before the cancel", len(baseline.Emails), len(grouped_emails))
+	}
+}
+
+func TestEmailSetContains(t *testing.T) {
+	dir, err := ioutil.TempDir("", "repoharvester")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	SPILL_DIR = dir
+	defer func() { SPILL_THRESHOLD = 0 }()
+	// 0 stays in memory, 3 spills part way through the adds
+	for _, threshold := range []int{0, 3} {
+		SPILL_THRESHOLD = threshold
+		set := &EmailSet{emails: make(map[string]uint)}
+		for _, email := range []string{"a@example.com", "b@example.com", "c@example.com", "d@example.com"} {
+			set.add(email)
+		}
+		if spilled := set.spill != nil; spilled != (threshold > 0) {
+			t.Errorf("threshold %d: spilled %v", threshold, spilled)
+		}
+		for _, email := range []string{"a@example.com", "d@example.com"} {
+			if !set.Contains(email) {
+				t.Errorf("threshold %d: Contains(%q) = false", threshold, email)
+			}
+		}
+		if set.Contains("e@example.com") {
+			t.Errorf("threshold %d: Contains(e@example.com) = true", threshold)
+		}
+		set.Close()
+	}
+}
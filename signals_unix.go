@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// kill -TSTP pauses the dispatch of new clones and shortlogs, kill -CONT resumes it
+var (
+	PAUSE_SIGNAL  os.Signal = syscall.SIGTSTP
+	RESUME_SIGNAL os.Signal = syscall.SIGCONT
+)
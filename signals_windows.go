@@ -0,0 +1,12 @@
+//go:build windows
+// +build windows
+
+package main
+
+import "os"
+
+// Windows has no job control signals so a harvest can't be paused there
+var (
+	PAUSE_SIGNAL  os.Signal
+	RESUME_SIGNAL os.Signal
+)